@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenField is the name of the field holding a form's token, if the sink
+// requires them. Like the honeypot, it isn't part of messages.
+const TokenField = "formsink-token"
+
+const (
+	defaultTokenMinAge = 3 * time.Second
+	defaultTokenMaxAge = 24 * time.Hour
+)
+
+// A Check looks at a submission before its message is built and returns
+// an error if it's from a bot. Such submissions are dropped, but answered
+// as if they had been accepted, so that bots can't tell.
+type Check interface {
+	Check(r *http.Request, form *Form, submission *multipart.Form) error
+}
+
+// CheckFunc lets an ordinary function be a Check.
+type CheckFunc func(r *http.Request, form *Form, submission *multipart.Form) error
+
+func (f CheckFunc) Check(r *http.Request, form *Form, submission *multipart.Form) error {
+	return f(r, form, submission)
+}
+
+// TokenConfig describes the signed timestamps that forms must submit in
+// their TokenField. The sink hands out a fresh token for a GET request to
+// a form's URL, which the page fetches and sets as the value of a hidden
+// input, or pages can be rendered with one from NewToken.
+type TokenConfig struct {
+	// Secret is the key tokens are signed with. Tokens are only required
+	// if it's set.
+	Secret []byte
+
+	// MinAge rejects submissions made sooner after the token was issued,
+	// which only bots manage. Defaults to 3 seconds. MaxAge rejects
+	// tokens issued longer ago. Defaults to 24 hours.
+	MinAge time.Duration
+	MaxAge time.Duration
+}
+
+// NewToken returns a token for the named form issued at t, e.g.
+// "1487980800.5d4…". It's the time in Unix seconds followed by its
+// HMAC-SHA256 along with the form's name, so that it only works for that
+// form.
+func NewToken(secret []byte, form string, t time.Time) string {
+	issued := strconv.FormatInt(t.Unix(), 10)
+	return issued + "." + signToken(secret, form, issued)
+}
+
+func signToken(secret []byte, form, issued string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(form + "\n" + issued))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// tokenCheck rejects submissions without a valid token of the right age.
+type tokenCheck struct {
+	config TokenConfig
+}
+
+func (tc *tokenCheck) Check(r *http.Request, form *Form, submission *multipart.Form) error {
+	values := submission.Value[TokenField]
+	if len(values) < 1 || values[0] == "" {
+		return e("missing token")
+	}
+
+	dot := strings.Index(values[0], ".")
+	if dot < 0 {
+		return e("malformed token %q", values[0])
+	}
+	issued, signature := values[0][:dot], values[0][dot+1:]
+	if !hmac.Equal([]byte(signature), []byte(signToken(tc.config.Secret, form.Name, issued))) {
+		return e("bad token signature")
+	}
+
+	unix, err := strconv.ParseInt(issued, 10, 64)
+	if err != nil {
+		return e("malformed token %q", values[0])
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age < tc.config.MinAge {
+		return e("submitted %v after the token was issued", age.Round(time.Millisecond))
+	}
+	if age > tc.config.MaxAge {
+		return e("token expired %v ago", (age - tc.config.MaxAge).Round(time.Second))
+	}
+	return nil
+}
+
+// serveToken responds with a fresh token for form.
+func (tc *tokenCheck) serveToken(w http.ResponseWriter, form *Form) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(NewToken(tc.config.Secret, form.Name, time.Now())))
+}
+
+// honeypotCheck rejects submissions that fill in a field which is hidden
+// from people, e.g. with CSS, but which bots fill in like any other.
+type honeypotCheck struct {
+	field string
+}
+
+func (hc *honeypotCheck) Check(r *http.Request, form *Form, submission *multipart.Form) error {
+	for _, value := range submission.Value[hc.field] {
+		if value != "" {
+			return e("honeypot field %q was filled in", hc.field)
+		}
+	}
+	return nil
+}
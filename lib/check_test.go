@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var checkedForm = &Form{
+	Name:        "contact",
+	Fields:      []string{"name", "website", TokenField},
+	Constraints: map[string]*Constraint{"name": &Constraint{Required: true}},
+}
+
+func submitValues(t *testing.T, sink http.Handler, values url.Values) *http.Response {
+	return submit(t, sink, "/contact", "application/x-www-form-urlencoded", values.Encode())
+}
+
+// Bots get the same response as people, even for invalid submissions.
+func TestHoneypot(t *testing.T) {
+	mock := &mockDepositor{}
+	sink, err := newSink(mock, Config{Redirect: location, Honeypot: "website"}, checkedForm)
+	require.Nil(t, err)
+
+	result := submitValues(t, sink, url.Values{"website": {"http://spam.example.com"}})
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+	assert.Equal(t, location, result.Header.Get("Location"))
+	assert.Nil(t, mock.msg)
+
+	result = submitValues(t, sink, url.Values{"name": {"crasm"}, "website": {""}})
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+	require.NotNil(t, mock.msg)
+	assert.Equal(t, "name: crasm\n", mock.msg.Body, "without the honeypot or token")
+}
+
+func TestToken(t *testing.T) {
+	secret := []byte("s3cret")
+	mock := &mockDepositor{}
+	sink, err := newSink(mock, Config{Redirect: location, Token: TokenConfig{Secret: secret}}, checkedForm)
+	require.Nil(t, err)
+
+	// Tokens are handed out for GET requests.
+	w := httptest.NewRecorder()
+	sink.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/contact", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	fresh, err := ioutil.ReadAll(w.Body)
+	require.Nil(t, err)
+
+	now := time.Now()
+	for _, token := range []string{
+		"",
+		string(fresh), // Too fast
+		NewToken(secret, "contact", now.Add(-25*time.Hour)),
+		NewToken(secret, "survey", now.Add(-time.Minute)),
+		NewToken([]byte("guess"), "contact", now.Add(-time.Minute)),
+		"1487980800",
+	} {
+		result := submitValues(t, sink, url.Values{"name": {"crasm"}, TokenField: {token}})
+		assert.Equal(t, http.StatusSeeOther, result.StatusCode, token)
+		assert.Nil(t, mock.msg, token)
+	}
+
+	result := submitValues(t, sink, url.Values{
+		"name":     {"crasm"},
+		TokenField: {NewToken(secret, "contact", now.Add(-time.Minute))},
+	})
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+	require.NotNil(t, mock.msg)
+	assert.Equal(t, "name: crasm\nwebsite: \n", mock.msg.Body, "without the token")
+}
+
+// Requests for absolute URIs have no path, which isn't any form's.
+func TestTokenAbsoluteURI(t *testing.T) {
+	sink, err := newSink(&mockDepositor{}, Config{Token: TokenConfig{Secret: []byte("s3cret")}}, checkedForm)
+	require.Nil(t, err)
+
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader("GET http://example.com HTTP/1.1\r\nHost: example.com\r\n\r\n")))
+	require.Nil(t, err)
+	require.Empty(t, r.URL.Path)
+	w := httptest.NewRecorder()
+	sink.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestChecks(t *testing.T) {
+	var checked *Form
+	mock := &mockDepositor{}
+	config := Config{Checks: []Check{CheckFunc(func(r *http.Request, form *Form, submission *multipart.Form) error {
+		checked = form
+		if submission.Value["name"][0] == "bot" {
+			return errors.New("bot")
+		}
+		return nil
+	})}}
+	sink, err := newSink(mock, config, checkedForm)
+	require.Nil(t, err)
+
+	result := submitValues(t, sink, url.Values{"name": {"bot"}})
+	assert.Equal(t, http.StatusNoContent, result.StatusCode)
+	assert.Nil(t, mock.msg)
+	require.NotNil(t, checked)
+	assert.Equal(t, "contact", checked.Name)
+
+	result = submitValues(t, sink, url.Values{"name": {"crasm"}})
+	assert.Equal(t, http.StatusNoContent, result.StatusCode)
+	assert.NotNil(t, mock.msg)
+}
@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"net/mail"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Config holds the settings shared by every form of a sink. Zero values
+// are replaced with defaults by NewSink.
+type Config struct {
+	// Maildir is the directory messages are stored in. Defaults to
+	// DefaultMaildirPath.
+	Maildir string
+
+	// MaildirFolders delivers each form's messages into a Maildir++
+	// folder named after it, e.g. .contact, unless the form names its own
+	// with data-formsink-folder.
+	MaildirFolders bool
+
+	// Redirect is where the user is sent after submitting a form, unless
+	// the form has its own. Without one, 204 No Content is returned.
+	Redirect string
+
+	// From is the sender of every message. Defaults to
+	// "FormSink <FormSink@Domain>".
+	From mail.Address
+
+	// Domain is the domain of a form's default recipient, e.g. contact
+	// is sent to contact@Domain. Defaults to the hostname.
+	Domain string
+
+	// To, Cc and Bcc map form names to their recipients. Forms with
+	// recipients of their own, e.g. from data-formsink-to, keep them.
+	To  map[string][]mail.Address
+	Cc  map[string][]mail.Address
+	Bcc map[string][]mail.Address
+
+	// SMTP, if its Addr is set, is a relay that messages are delivered to
+	// instead of Maildir.
+	SMTP SMTPConfig
+
+	// LMTP, if its Addr is set, is a server such as Dovecot that messages
+	// are delivered to instead of Maildir.
+	LMTP LMTPConfig
+
+	// IMAP, if its Addr is set, is a server that messages are appended to
+	// instead of Maildir.
+	IMAP IMAPConfig
+
+	// Exec, if its Command is set, is run for each message with the
+	// message on its standard input, instead of Maildir.
+	Exec ExecConfig
+
+	// Webhook, if its URL is set, receives submissions as JSON instead of
+	// them being delivered as messages.
+	Webhook WebhookConfig
+
+	// Mbox, if set, is an mbox file that messages are appended to instead
+	// of being stored in Maildir. With MboxPerForm, it's a directory of
+	// mbox files named after each form instead, e.g. contact.mbox.
+	Mbox        string
+	MboxPerForm bool
+
+	// Deliver lists where messages are delivered, in order: any of
+	// "maildir", "mbox", "smtp", "lmtp", "imap", "exec" and "webhook", as
+	// configured above, or URLs of depositors for OpenDepositor, e.g.
+	// "mbox:/var/mail/forms". Defaults to the first of webhook, SMTP,
+	// LMTP, IMAP, exec and mbox that is configured, or else to maildir.
+	Deliver []string
+
+	// BestEffort lists the targets of Deliver whose failures are logged
+	// but don't fail the submission.
+	BestEffort []string
+
+	// Spool, if its Dir is set, is where submissions are kept until
+	// they're delivered. They're accepted as soon as they're spooled and
+	// delivered in the background, with failed deliveries retried.
+	Spool SpoolConfig
+
+	// PGPKeys are files of ASCII-armored public keys. If there are any,
+	// messages are encrypted to all of them before being stored, and
+	// every target of Deliver must be a RawDepositor, which the webhook
+	// isn't.
+	PGPKeys []string
+
+	// Honeypot, if set, names a field that must be left empty. It should
+	// be hidden from people, so that only bots fill it in.
+	Honeypot string
+
+	// Token, if its Secret is set, requires every form to submit a recent
+	// token in its TokenField.
+	Token TokenConfig
+
+	// Checks are run on every submission after those for Honeypot and
+	// Token, to drop ones from bots.
+	Checks []Check
+
+	// AllowedOrigins are sites such as "https://example.com" that every
+	// form may be submitted from, besides those in its Origins. If a form
+	// has any, submissions from any other site but formsink's own are
+	// rejected with 403 Forbidden. "*" allows every site.
+	AllowedOrigins []string
+
+	// CORSOrigins are sites such as "https://example.com" whose pages may
+	// submit forms with fetch() and read the responses, which they get as
+	// JSON if they accept it. They're still only accepted from origins
+	// the form allows, as listed in AllowedOrigins or Form.Origins. "*"
+	// allows every site.
+	CORSOrigins []string
+
+	// RateLimit limits how often forms can be submitted.
+	RateLimit RateLimitConfig
+
+	// Limits bound the size of submissions to forms that don't set limits
+	// of their own, e.g. with data-formsink-max-size.
+	Limits Limits
+}
+
+// withDefaults returns a copy of c with its zero values filled in.
+func (c Config) withDefaults() Config {
+	if c.Maildir == "" {
+		c.Maildir = DefaultMaildirPath
+	}
+
+	if c.Domain == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"err": err,
+			}).Warn("Couldn't read hostname")
+
+			hostname = "example.com"
+		}
+		c.Domain = hostname
+	}
+
+	if c.From.Address == "" {
+		name := c.From.Name
+		if name == "" {
+			name = "FormSink"
+		}
+		c.From = mail.Address{
+			Name:    name,
+			Address: "FormSink@" + c.Domain,
+		}
+	}
+
+	if c.Limits.MaxBodySize == 0 {
+		c.Limits.MaxBodySize = defaultMaxBodySize
+	}
+
+	if len(c.Token.Secret) > 0 {
+		if c.Token.MinAge == 0 {
+			c.Token.MinAge = defaultTokenMinAge
+		}
+		if c.Token.MaxAge == 0 {
+			c.Token.MaxAge = defaultTokenMaxAge
+		}
+	}
+
+	return c
+}
@@ -1,44 +1,251 @@
 package lib
 
 import (
-	"github.com/Sirupsen/logrus"
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
 	"github.com/jpoehls/gophermail"
 	"github.com/luksen/maildir"
 )
 
-type depositor interface {
-	Deposit(*gophermail.Message) error
+// A Depositor stores or forwards submissions, e.g. by writing them into a
+// maildir or relaying them over SMTP. Deposit may be called concurrently.
+// ctx is canceled if whoever submitted the form goes away, so Depositors
+// that take a while should give up when it is.
+type Depositor interface {
+	Deposit(ctx context.Context, s *Submission) error
 }
 
+// Submission is a form submission that passed validation.
+type Submission struct {
+	// Message is the message built from the submission, after its form's
+	// template, if any, was applied. Its attachments can only be read
+	// once.
+	Message *gophermail.Message
+
+	// Data is what was submitted, with the form it was submitted through
+	// and details of the request. It's nil if only the message is known.
+	Data *TemplateData
+}
+
+// A RawDepositor can also store a message that has already been encoded,
+// e.g. encrypted for Config.PGPKeys, which only works with depositors
+// that are RawDepositors. msg is the message raw was built from, for
+// depositors that need its recipients or form; what's stored is raw.
+type RawDepositor interface {
+	Depositor
+	DepositRaw(ctx context.Context, msg *gophermail.Message, raw []byte) error
+}
+
+// maildirDepositor stores messages in a maildir, either at its root or in
+// Maildir++ folders, which are created when they're first delivered to.
 type maildirDepositor struct {
-	dir maildir.Dir
+	dir     maildir.Dir
+	folders bool // Whether each form gets a folder by default
+
+	mu      sync.Mutex
+	created map[string]bool // Folders known to exist
 }
 
-func newMaildirDepositor(dirname string) *maildirDepositor {
+func newMaildirDepositor(dirname string, folders bool) (*maildirDepositor, error) {
 	dir := maildir.Dir(dirname)
-	err := dir.Create()
+	if err := dir.Create(); err != nil {
+		return nil, e("problem initializing maildir %s: %v", dirname, err)
+	}
+	return &maildirDepositor{dir: dir, folders: folders, created: map[string]bool{}}, nil
+}
+
+func (m *maildirDepositor) Deposit(ctx context.Context, s *Submission) error {
+	msgBytes, err := s.Message.Bytes()
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"maildir": dirname,
-			"err":     err.Error(),
-		}).Fatal("Problem initializing maildir")
+		return err
 	}
-	return &maildirDepositor{dir}
+
+	return m.DepositRaw(ctx, s.Message, msgBytes)
 }
 
-func (m *maildirDepositor) Deposit(msg *gophermail.Message) error {
+func (m *maildirDepositor) DepositRaw(ctx context.Context, msg *gophermail.Message, raw []byte) error {
+	dir := m.dir
+	folder := msg.Headers.Get(folderHeader)
+	if folder == "" && m.folders {
+		name, err := formName(msg)
+		if err != nil {
+			return err
+		}
+		folder = name
+	}
+	if folder != "" {
+		var err error
+		if dir, err = m.folder(folder); err != nil {
+			return err
+		}
+	}
 
-	delivery, err := m.dir.NewDelivery()
+	delivery, err := dir.NewDelivery()
 	if err != nil {
 		return err
 	}
 	defer delivery.Close()
 
-	msgBytes, err := msg.Bytes()
+	_, err = delivery.Write(raw)
+	return err
+}
+
+// folder returns the Maildir++ folder with the given name, e.g. .contact
+// for "contact", creating it if needed.
+func (m *maildirDepositor) folder(name string) (maildir.Dir, error) {
+	if !validFolder(name) {
+		return "", e("invalid maildir folder %q", name)
+	}
+	dir := maildir.Dir(filepath.Join(string(m.dir), "."+name))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.created[name] {
+		return dir, nil
+	}
+
+	if err := dir.Create(); err != nil {
+		return "", err
+	}
+	// Marks the directory as a folder rather than a maildir of its own.
+	f, err := os.OpenFile(filepath.Join(string(dir), "maildirfolder"), os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
-		return err
+		return "", err
+	}
+	f.Close()
+
+	m.created[name] = true
+	return dir, nil
+}
+
+// validFolder reports whether name is a Maildir++ folder name, where dots
+// separate nested folders, e.g. "forms.contact".
+func validFolder(name string) bool {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return false
 	}
+	for _, part := range strings.Split(name, ".") {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
 
-	_, err = delivery.Write(msgBytes)
+// DeliveryError is a reply from a mail server refusing a message, either
+// for a single recipient or as a whole.
+type DeliveryError struct {
+	Recipient string // "" if not specific to a recipient
+	Code      int
+	Message   string
+}
+
+func (de *DeliveryError) Error() string {
+	if de.Recipient == "" {
+		return e("%d %s", de.Code, de.Message).Error()
+	}
+	return e("%s: %d %s", de.Recipient, de.Code, de.Message).Error()
+}
+
+// Temporary reports whether the server may accept the message if it's
+// sent again later, i.e. whether the reply was 4xx rather than 5xx.
+func (de *DeliveryError) Temporary() bool {
+	return de.Code >= 400 && de.Code < 500
+}
+
+// DeliveryErrors are the failures of a message that was refused by at
+// least one recipient.
+type DeliveryErrors []*DeliveryError
+
+func (des DeliveryErrors) Error() string {
+	errs := make([]string, 0, len(des))
+	for _, de := range des {
+		errs = append(errs, de.Error())
+	}
+	return strings.Join(errs, "; ")
+}
+
+// Temporary reports whether every failure was temporary.
+func (des DeliveryErrors) Temporary() bool {
+	for _, de := range des {
+		if !de.Temporary() {
+			return false
+		}
+	}
+	return true
+}
+
+// PartialDeliveryError is returned for a message that some recipients
+// refused temporarily, while trying again would be wrong for the others,
+// since they've received it or refused it for good. Only the recipients of
+// Failures, which are all temporary, should get it again.
+type PartialDeliveryError struct {
+	Failures DeliveryErrors
+}
+
+func (pe *PartialDeliveryError) Error() string {
+	return pe.Failures.Error()
+}
+
+func (pe *PartialDeliveryError) Temporary() bool {
+	return true
+}
+
+// Recipients lists the recipients to try again.
+func (pe *PartialDeliveryError) Recipients() []string {
+	recipients := make([]string, 0, len(pe.Failures))
+	for _, failure := range pe.Failures {
+		recipients = append(recipients, failure.Recipient)
+	}
+	return recipients
+}
+
+// isTemporary reports whether err, or an error it wraps, says that trying
+// again later may succeed.
+func isTemporary(err error) bool {
+	var temporary interface {
+		Temporary() bool
+	}
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// isPermanent reports whether err is a refusal saying that trying again
+// won't succeed, e.g. a 5xx reply. Network errors don't say whether the
+// submission would be accepted, so they aren't.
+func isPermanent(err error) bool {
+	var temporary interface {
+		Temporary() bool
+	}
+	if !errors.As(err, &temporary) {
+		return false
+	}
+	if _, ok := temporary.(net.Error); ok {
+		return false
+	}
+	return !temporary.Temporary()
+}
+
+// permanentError is a failure that trying again won't fix.
+type permanentError struct {
+	error
+}
+
+func (permanentError) Temporary() bool {
+	return false
+}
+
+// deliveryError converts a *textproto.Error into a *DeliveryError,
+// leaving other errors, e.g. from the network, as they are.
+func deliveryError(rcpt string, err error) error {
+	if terr, ok := err.(*textproto.Error); ok {
+		return &DeliveryError{rcpt, terr.Code, terr.Msg}
+	}
 	return err
 }
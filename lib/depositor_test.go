@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/luksen/maildir"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaildirFolders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := newMaildirDepositor(dir, true)
+	require.Nil(t, err)
+	require.Nil(t, depositMessage(m, formMessage("contact")))
+	require.Nil(t, depositMessage(m, formMessage("contact")))
+
+	named := formMessage("newsletter")
+	named.Headers[folderHeader] = []string{"forms.newsletter"}
+	require.Nil(t, depositMessage(m, named))
+
+	for folder, count := range map[string]int{
+		".contact":          2,
+		".forms.newsletter": 1,
+		"":                  0,
+	} {
+		keys, err := maildir.Dir(filepath.Join(dir, folder)).Unseen()
+		require.Nil(t, err, folder)
+		assert.Len(t, keys, count, folder)
+
+		_, err = os.Stat(filepath.Join(dir, folder, "maildirfolder"))
+		assert.Equal(t, folder != "", err == nil, folder)
+	}
+
+	assert.NotNil(t, depositMessage(m, formMessage("../contact")))
+}
+
+// Without folders, only forms that name one get one.
+func TestMaildirRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := newMaildirDepositor(dir, false)
+	require.Nil(t, err)
+	require.Nil(t, depositMessage(m, formMessage("contact")))
+
+	named := formMessage("newsletter")
+	named.Headers[folderHeader] = []string{"newsletter"}
+	require.Nil(t, depositMessage(m, named))
+
+	keys, err := maildir.Dir(dir).Unseen()
+	require.Nil(t, err)
+	assert.Len(t, keys, 1)
+
+	keys, err = maildir.Dir(filepath.Join(dir, ".newsletter")).Unseen()
+	require.Nil(t, err)
+	assert.Len(t, keys, 1)
+
+	_, err = os.Stat(filepath.Join(dir, ".contact"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestValidFolder(t *testing.T) {
+	for _, name := range []string{"contact", "forms.contact", "Contact Us"} {
+		assert.True(t, validFolder(name), name)
+	}
+	for _, name := range []string{"", ".contact", "contact.", "forms..contact", "../contact", `a\b`} {
+		assert.False(t, validFolder(name), name)
+	}
+}
@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/jpoehls/gophermail"
+)
+
+const defaultExecTimeout = 30 * time.Second
+
+// The exit status of sendmail, procmail and others when a message should be
+// sent again later, from sysexits.h.
+const exTempFail = 75
+
+// ExecConfig describes a command, such as "sendmail -t", that messages are
+// piped to instead of being stored in a maildir.
+type ExecConfig struct {
+	// Command is the program and its arguments. It's run directly rather
+	// than by a shell.
+	Command []string
+
+	// Timeout limits how long the command may run before it's killed.
+	// Defaults to 30 seconds.
+	Timeout time.Duration
+
+	// TempFail lists the exit statuses meaning that the message may be
+	// accepted later. Defaults to 75, EX_TEMPFAIL. Any other status but 0
+	// is a permanent failure.
+	TempFail []int
+}
+
+// execDepositor runs a command for each message, with the message on its
+// standard input and details of the submission in its environment:
+//
+//	FORMSINK_FORM        the form's name
+//	FORMSINK_FROM        the sender's address
+//	FORMSINK_RECIPIENTS  the To, Cc and Bcc addresses, separated by commas
+//	FORMSINK_REPLY_TO    the submitter's address, if known
+//	FORMSINK_SUBJECT     the subject
+type execDepositor struct {
+	config ExecConfig
+}
+
+func newExecDepositor(config ExecConfig) (*execDepositor, error) {
+	if len(config.Command) == 0 || config.Command[0] == "" {
+		return nil, e("missing command")
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultExecTimeout
+	}
+	if config.TempFail == nil {
+		config.TempFail = []int{exTempFail}
+	}
+	return &execDepositor{config}, nil
+}
+
+func (x *execDepositor) Deposit(ctx context.Context, s *Submission) error {
+	raw, err := s.Message.Bytes()
+	if err != nil {
+		return err
+	}
+
+	return x.DepositRaw(ctx, s.Message, raw)
+}
+
+func (x *execDepositor) DepositRaw(ctx context.Context, msg *gophermail.Message, raw []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, x.config.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, x.config.Command[0], x.config.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(raw)
+	cmd.Env = append(os.Environ(),
+		"FORMSINK_FORM="+msg.Headers.Get(formHeader),
+		"FORMSINK_FROM="+msg.From.Address,
+		"FORMSINK_RECIPIENTS="+strings.Join(envelopeRecipients(ctx, msg), ","),
+		"FORMSINK_REPLY_TO="+msg.ReplyTo.Address,
+		"FORMSINK_SUBJECT="+msg.Subject,
+	)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	// Don't wait for children of a killed command still holding stderr.
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	execErr := &ExecError{Command: x.config.Command[0], ExitCode: -1, Stderr: lastLine(stderr.String())}
+	var exitErr *exec.ExitError
+	if ctx.Err() == context.DeadlineExceeded {
+		execErr.TimedOut = true
+	} else if errors.As(err, &exitErr) {
+		execErr.ExitCode = exitErr.ExitCode()
+		execErr.temporary = containsInt(x.config.TempFail, execErr.ExitCode)
+	} else {
+		return err // It couldn't be started
+	}
+	return execErr
+}
+
+// ExecError is the failure of a command run for a message.
+type ExecError struct {
+	Command  string
+	ExitCode int    // -1 if it was killed
+	TimedOut bool   // Whether it was killed for running too long
+	Stderr   string // The last line it wrote to standard error
+
+	temporary bool
+}
+
+func (xe *ExecError) Error() string {
+	var err error
+	if xe.TimedOut {
+		err = e("%s timed out", xe.Command)
+	} else {
+		err = e("%s exited with status %d", xe.Command, xe.ExitCode)
+	}
+	if xe.Stderr != "" {
+		return err.Error() + ": " + xe.Stderr
+	}
+	return err.Error()
+}
+
+// Temporary reports whether the command timed out or exited with one of
+// ExecConfig.TempFail.
+func (xe *ExecError) Temporary() bool {
+	return xe.TimedOut || xe.temporary
+}
+
+// lastLine returns the last non-blank line of s.
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	return s[strings.LastIndex(s, "\n")+1:]
+}
+
+func containsInt(list []int, n int) bool {
+	for _, i := range list {
+		if i == n {
+			return true
+		}
+	}
+	return false
+}
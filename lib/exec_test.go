@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Runs script with sh, with $1 being a file in dir.
+func shell(dir, script string) []string {
+	return []string{"sh", "-c", script, "sh", filepath.Join(dir, "out")}
+}
+
+func TestExec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	x, err := newExecDepositor(ExecConfig{
+		Command: shell(dir, `cat > "$1" && env | grep ^FORMSINK_ | sort > "$1.env"`),
+	})
+	require.Nil(t, err)
+
+	msg := formMessage("contact")
+	msg.Headers = mail.Header{formHeader: {"contact"}}
+	require.Nil(t, depositMessage(x, msg))
+
+	out, err := ioutil.ReadFile(filepath.Join(dir, "out"))
+	require.Nil(t, err)
+	assert.Contains(t, string(out), "Subject: contact request")
+
+	env, err := ioutil.ReadFile(filepath.Join(dir, "out.env"))
+	require.Nil(t, err)
+	assert.Equal(t, "FORMSINK_FORM=contact\n"+
+		"FORMSINK_FROM="+msg.From.Address+"\n"+
+		"FORMSINK_RECIPIENTS="+msg.To[0].Address+",archive@vczf.io,audit@vczf.io\n"+
+		"FORMSINK_REPLY_TO=crasm@formsink.email.vczf.io\n"+
+		"FORMSINK_SUBJECT=contact request\n", string(env))
+}
+
+func TestExecErrors(t *testing.T) {
+	cases := []struct {
+		script    string
+		exitCode  int
+		timedOut  bool
+		temporary bool
+		stderr    string
+	}{
+		{`echo "try later" >&2; exit 75`, 75, false, true, "try later"},
+		{`echo "ignored" >&2; echo "no such user" >&2; exit 67`, 67, false, false, "no such user"},
+		{`exit 1`, 1, false, false, ""},
+		{`exec sleep 5`, -1, true, true, ""},
+	}
+
+	for _, c := range cases {
+		x, err := newExecDepositor(ExecConfig{
+			Command: []string{"sh", "-c", c.script},
+			Timeout: 100 * time.Millisecond,
+		})
+		require.Nil(t, err)
+
+		err = depositMessage(x, simpleMessage())
+		require.IsType(t, &ExecError{}, err, c.script)
+		execErr := err.(*ExecError)
+		assert.Equal(t, c.exitCode, execErr.ExitCode, c.script)
+		assert.Equal(t, c.timedOut, execErr.TimedOut, c.script)
+		assert.Equal(t, c.temporary, execErr.Temporary(), c.script)
+		assert.Equal(t, c.stderr, execErr.Stderr, c.script)
+	}
+
+	// Custom temporary failures
+	x, err := newExecDepositor(ExecConfig{Command: []string{"sh", "-c", "exit 3"}, TempFail: []int{3}})
+	require.Nil(t, err)
+	assert.True(t, isTemporary(depositMessage(x, simpleMessage())))
+
+	// Not found
+	x, err = newExecDepositor(ExecConfig{Command: []string{"/nonexistent/sendmail"}})
+	require.Nil(t, err)
+	err = depositMessage(x, simpleMessage())
+	assert.NotNil(t, err)
+	assert.False(t, isTemporary(err))
+
+	_, err = newExecDepositor(ExecConfig{})
+	assert.NotNil(t, err)
+}
+
+func TestExecStatus(t *testing.T) {
+	for code, status := range map[string]int{
+		"0":  http.StatusSeeOther,
+		"75": http.StatusServiceUnavailable,
+		"1":  http.StatusInternalServerError,
+	} {
+		x, err := newExecDepositor(ExecConfig{Command: []string{"sh", "-c", "cat > /dev/null; exit " + code}})
+		require.Nil(t, err)
+		sink, err := newSink(x, Config{Redirect: location}, simpleForm)
+		require.Nil(t, err)
+
+		result := post(t, sink)
+		assert.Equal(t, status, result.StatusCode, code)
+	}
+}
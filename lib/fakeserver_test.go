@@ -0,0 +1,48 @@
+package lib
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer is what in-process stand-ins for mail servers have in common:
+// a listener whose connections are each served in the background.
+type fakeServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config // For STARTTLS, if not nil
+	implicit  bool        // Whether listener is already TLS
+}
+
+// listenFake listens on addr, with TLS from the start if implicit.
+func listenFake(t *testing.T, network, addr string, tlsConfig *tls.Config, implicit bool) fakeServer {
+	listener, err := net.Listen(network, addr)
+	require.Nil(t, err)
+	if implicit {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return fakeServer{listener, tlsConfig, implicit}
+}
+
+// accept hands each connection to serve until the server is closed.
+func (f *fakeServer) accept(serve func(net.Conn)) {
+	go func() {
+		for {
+			conn, err := f.listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+}
+
+func (f *fakeServer) Addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeServer) Close() {
+	f.listener.Close()
+}
@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jpoehls/gophermail"
+)
+
+// fanoutTarget is one of the depositors of a fanoutDepositor.
+type fanoutTarget struct {
+	name      string // For errors and logs, e.g. "maildir"
+	depositor Depositor
+	required  bool // Whether the submission fails if this target does
+}
+
+// fanoutDepositor delivers every submission to each of its targets in
+// turn. Failures of best-effort targets are only logged, while those of
+// required targets make the whole deposit fail, after every target has
+// been tried.
+type fanoutDepositor struct {
+	targets []fanoutTarget
+}
+
+func newFanoutDepositor(targets ...fanoutTarget) *fanoutDepositor {
+	return &fanoutDepositor{targets}
+}
+
+func (f *fanoutDepositor) Deposit(ctx context.Context, s *Submission) error {
+	msg := s.Message
+
+	// Attachments can only be read once, so each target gets a copy.
+	attachments := make([][]byte, len(msg.Attachments))
+	for i, a := range msg.Attachments {
+		contents, err := ioutil.ReadAll(a.Data)
+		if err != nil {
+			return err
+		}
+		attachments[i] = contents
+	}
+
+	failures := TargetErrors{}
+	for _, target := range f.targets {
+		targetMsg := *msg
+		targetMsg.Attachments = make([]gophermail.Attachment, len(msg.Attachments))
+		for i, a := range msg.Attachments {
+			a.Data = bytes.NewReader(attachments[i])
+			targetMsg.Attachments[i] = a
+		}
+
+		err := target.depositor.Deposit(ctx, &Submission{&targetMsg, s.Data})
+		if err == nil {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"target":   target.name,
+			"required": target.required,
+			"error":    err.Error(),
+		}).Warn("Delivery to target failed")
+		if target.required {
+			failures = append(failures, &TargetError{target.name, err})
+		}
+	}
+
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+// TargetError is the failure of a required target of a fan-out.
+type TargetError struct {
+	Target string
+	Err    error
+}
+
+func (te *TargetError) Error() string {
+	return te.Target + ": " + te.Err.Error()
+}
+
+// Temporary reports whether the target may succeed if tried again later.
+func (te *TargetError) Temporary() bool {
+	return isTemporary(te.Err)
+}
+
+// TargetErrors are the failures of the required targets of a fan-out.
+type TargetErrors []*TargetError
+
+func (tes TargetErrors) Error() string {
+	errs := make([]string, 0, len(tes))
+	for _, te := range tes {
+		errs = append(errs, te.Error())
+	}
+	return strings.Join(errs, "; ")
+}
+
+// Temporary reports whether every failure was temporary.
+func (tes TargetErrors) Temporary() bool {
+	for _, te := range tes {
+		if !te.Temporary() {
+			return false
+		}
+	}
+	return true
+}
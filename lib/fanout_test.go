@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingDepositor struct {
+	err   error
+	tried bool
+}
+
+func (f *failingDepositor) Deposit(ctx context.Context, s *Submission) error {
+	f.tried = true
+	return f.err
+}
+
+// Every target gets the whole message, including its attachments.
+func TestFanout(t *testing.T) {
+	first := &mockDepositor{}
+	second := &mockDepositor{}
+	fanout := newFanoutDepositor(
+		fanoutTarget{"first", first, true},
+		fanoutTarget{"second", second, true},
+	)
+
+	sink, err := newSink(fanout, Config{Redirect: location}, simpleForm)
+	require.Nil(t, err)
+
+	result := post(t, sink)
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+	checkMessage(t, first.msg)
+	checkMessage(t, second.msg)
+	require.NotNil(t, second.data)
+	assert.Equal(t, "crasm", second.data.Value("name"))
+}
+
+func TestFanoutFailures(t *testing.T) {
+	temporary := &DeliveryError{Code: 451, Message: "Try again"}
+	permanent := &DeliveryError{Code: 550, Message: "No"}
+
+	cases := []struct {
+		err      error
+		required bool
+		status   int
+	}{
+		{permanent, false, http.StatusSeeOther},
+		{temporary, false, http.StatusSeeOther},
+		{permanent, true, http.StatusInternalServerError},
+		{temporary, true, http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		failing := &failingDepositor{err: c.err}
+		last := &mockDepositor{}
+		fanout := newFanoutDepositor(
+			fanoutTarget{"failing", failing, c.required},
+			fanoutTarget{"last", last, true},
+		)
+
+		sink, err := newSink(fanout, Config{Redirect: location}, simpleForm)
+		require.Nil(t, err)
+
+		result := post(t, sink)
+		assert.Equal(t, c.status, result.StatusCode, c.err.Error())
+		assert.True(t, failing.tried)
+		checkMessage(t, last.msg)
+	}
+
+	fanout := newFanoutDepositor(
+		fanoutTarget{"temporary", &failingDepositor{err: temporary}, true},
+		fanoutTarget{"permanent", &failingDepositor{err: permanent}, true},
+	)
+	err := depositMessage(fanout, formMessage("contact"))
+	require.IsType(t, TargetErrors{}, err)
+	assert.Len(t, err.(TargetErrors), 2)
+	assert.Equal(t, "temporary", err.(TargetErrors)[0].Target)
+	assert.False(t, isTemporary(err))
+}
+
+func TestConfigDeliver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{
+		Maildir:    filepath.Join(dir, "Maildir"),
+		Mbox:       filepath.Join(dir, "formsink.mbox"),
+		Deliver:    []string{"maildir", "mbox"},
+		BestEffort: []string{"mbox"},
+	}
+	d, err := newConfigDepositor(config)
+	require.Nil(t, err)
+	require.IsType(t, &fanoutDepositor{}, d)
+	targets := d.(*fanoutDepositor).targets
+	require.Len(t, targets, 2)
+	assert.IsType(t, &maildirDepositor{}, targets[0].depositor)
+	assert.True(t, targets[0].required)
+	assert.IsType(t, &mboxDepositor{}, targets[1].depositor)
+	assert.False(t, targets[1].required)
+
+	// A single target isn't wrapped.
+	config.Deliver = []string{"mbox"}
+	d, err = newConfigDepositor(config)
+	require.Nil(t, err)
+	assert.IsType(t, &mboxDepositor{}, d)
+
+	for _, c := range []Config{
+		Config{Deliver: []string{"pigeon"}},
+		Config{Deliver: []string{"smtp"}},
+		Config{Deliver: []string{"maildir"}, BestEffort: []string{"mbox"}},
+	} {
+		c.Maildir = config.Maildir
+		_, err := newConfigDepositor(c)
+		assert.NotNil(t, err, c.Deliver)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build aix || solaris
+// +build aix solaris
+
+package lib
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// Systems without flock lock the whole file with fcntl instead, which is
+// what their mail tools use.
+func lockFile(f *os.File) error {
+	return fcntlLock(f, syscall.F_WRLCK)
+}
+
+func unlockFile(f *os.File) error {
+	return fcntlLock(f, syscall.F_UNLCK)
+}
+
+func fcntlLock(f *os.File, lockType int16) error {
+	lock := syscall.Flock_t{Type: lockType, Whence: io.SeekStart}
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, &lock)
+}
@@ -1,21 +1,225 @@
 package lib
 
 import (
+	"net/mail"
 	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/Sirupsen/logrus"
 )
 
 type Form struct {
 	Name   string
 	Fields []string
 	Files  []string
+
+	// Constraints maps a field or file name to the HTML5 constraint
+	// attributes declared on it. Names without any constraint attributes
+	// are absent.
+	Constraints map[string]*Constraint
+
+	// Multiple holds the names of fields and files that may carry more
+	// than one value, e.g. checkbox groups, <select multiple> and
+	// <input type='file' multiple>.
+	Multiple map[string]bool
+
+	// Labels maps field and file names to the human-readable text of
+	// their <label>, falling back to aria-label and then placeholder.
+	// Names without any such text are absent.
+	Labels map[string]string
+
+	// Legends maps field and file names to the <legend> of the
+	// <fieldset>s containing them, outermost first and joined by " > ".
+	// Names outside of any fieldset are absent.
+	Legends map[string]string
+
+	// ReplyTo is the name of the field holding the submitter's email
+	// address, either the first one marked with data-formsink-reply-to or
+	// else the first <input type='email'>. ReplyToName is the field
+	// holding their name, marked with data-formsink-reply-to-name or else
+	// autocomplete='name'. Either can be "".
+	ReplyTo     string
+	ReplyToName string
+
+	// Origins are the sites the form may be submitted from, e.g.
+	// "https://example.com": that of the page it was read from, if the
+	// page has a <base href>, <link rel='canonical'> or og:url, and those
+	// listed in its data-formsink-origins.
+	Origins []string
+
+	// Per-form settings read from data-formsink-* attributes on the
+	// <form>. Zero values fall back to the sink's defaults.
+	Redirect      string         // data-formsink-redirect
+	ErrorRedirect string         // data-formsink-error-redirect
+	Subject       string         // data-formsink-subject
+	To            []mail.Address // data-formsink-to
+	Cc            []mail.Address // data-formsink-cc
+	Bcc           []mail.Address // data-formsink-bcc
+	MaxSize       int64          // data-formsink-max-size, in bytes
+	MaxFileSize   int64          // data-formsink-max-file-size, in bytes
+	MaxFiles      int            // data-formsink-max-files
+	MaxFieldSize  int64          // data-formsink-max-field-size, in bytes
+	Template      string         // data-formsink-template, a file path relative to the page
+	Folder        string         // data-formsink-folder, a Maildir++ folder
+}
+
+// withoutFields returns a copy of f without the named fields, or f itself
+// if it has none of them.
+func (f *Form) withoutFields(names ...string) *Form {
+	fields := make([]string, 0, len(f.Fields))
+	for _, name := range f.Fields {
+		if !contains(names, name) {
+			fields = append(fields, name)
+		}
+	}
+	if len(fields) == len(f.Fields) {
+		return f
+	}
+
+	c := *f
+	c.Fields = fields
+	return &c
+}
+
+// label returns the human-readable name of a field or file, or its name
+// attribute if it has none.
+func (f *Form) label(name string) string {
+	if label := f.Labels[name]; label != "" {
+		return label
+	}
+	return name
+}
+
+// Constraint holds the HTML5 constraint validation attributes of a
+// submittable element, so that the server can enforce the same contract
+// as the browser.
+type Constraint struct {
+	Required bool
+
+	// Type is one of "email", "url", "number" or "date", or "" if the
+	// element's type does not constrain its value.
+	Type string
+
+	// MinLength and MaxLength are in characters; zero means unset.
+	MinLength int
+	MaxLength int
+
+	// Pattern is a regular expression that must match the entire value.
+	Pattern string
+
+	// Min and Max are bounds for "number" and "date" types.
+	Min string
+	Max string
+
+	// Options are the only values that may be submitted, taken from the
+	// <option>s of a <select> or the values of a radio or checkbox group.
+	// nil means any value is allowed, as it is if another element with the
+	// same name, e.g. a hidden input, can submit anything.
+	Options []string
+}
+
+// merge combines the constraints of another element with the same name,
+// e.g. the buttons of a radio group.
+func (c *Constraint) merge(other *Constraint) {
+	c.Required = c.Required || other.Required
+	c.Options = append(c.Options, other.Options...)
+}
+
+// constrainedTypes are the input types whose values formsink checks.
+var constrainedTypes = map[string]bool{
+	"email":  true,
+	"url":    true,
+	"number": true,
+	"date":   true,
+}
+
+// selectionToConstraint reads the constraint attributes of a submittable
+// element, returning nil if there are none.
+func selectionToConstraint(sel *goquery.Selection) (*Constraint, error) {
+	name, _ := sel.Attr("name")
+	c := &Constraint{}
+	found := false
+
+	if _, ok := sel.Attr("required"); ok {
+		c.Required = true
+		found = true
+	}
+
+	if t, ok := sel.Attr("type"); ok && sel.Is("input") && constrainedTypes[t] {
+		c.Type = t
+		found = true
+	}
+
+	for attr, dst := range map[string]*int{
+		"minlength": &c.MinLength,
+		"maxlength": &c.MaxLength,
+	} {
+		v, ok := sel.Attr(attr)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, e("invalid '%s' attribute %q on field %q", attr, v, name)
+		}
+		*dst = n
+		found = true
+	}
+
+	for attr, dst := range map[string]*string{
+		"pattern": &c.Pattern,
+		"min":     &c.Min,
+		"max":     &c.Max,
+	} {
+		if v, ok := sel.Attr(attr); ok {
+			*dst = v
+			found = true
+		}
+	}
+
+	if sel.Is("select") {
+		sel.Find("option").Each(func(_ int, option *goquery.Selection) {
+			// Without a value attribute, an option submits its text.
+			value, ok := option.Attr("value")
+			if !ok {
+				value = strings.TrimSpace(option.Text())
+			}
+			c.Options = append(c.Options, value)
+			found = true
+		})
+	} else if sel.Is("input[type='radio'], input[type='checkbox']") {
+		// Browsers submit "on" for checkboxes without a value attribute.
+		c.Options = []string{sel.AttrOr("value", "on")}
+		found = true
+	}
+
+	// Browsers ignore patterns they can't compile, and Go's regexp package
+	// can't compile some that browsers can, e.g. lookaheads like (?=.*\d),
+	// so those aren't checked at all.
+	if c.Pattern != "" {
+		if _, err := c.patternRegexp(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"field":   name,
+				"pattern": c.Pattern,
+				"error":   err.Error(),
+			}).Warn("Ignoring unsupported 'pattern' attribute")
+			c.Pattern = ""
+		}
+	}
+
+	if !found {
+		return nil, nil
+	}
+	return c, nil
 }
 
 func documentsToForms(documents ...*goquery.Document) ([]*Form, error) {
 	forms := make([]*Form, 0)
 	for _, doc := range documents {
 		var err error
+		site := pageOrigin(doc)
 
 		doc.Find(
 			"form",
@@ -41,27 +245,113 @@ func documentsToForms(documents ...*goquery.Document) ([]*Form, error) {
 			}
 
 			f := &Form{
-				Name:   u.Path[1:], // e.g. string("/contact")[1:] => "contact"
-				Fields: []string{},
-				Files:  []string{},
+				Name:        u.Path[1:], // e.g. string("/contact")[1:] => "contact"
+				Fields:      []string{},
+				Files:       []string{},
+				Constraints: map[string]*Constraint{},
+				Multiple:    map[string]bool{},
+				Labels:      map[string]string{},
+				Legends:     map[string]string{},
 			}
 
+			err = readSettings(f, sel)
+			if err != nil {
+				return false
+			}
+			if site != "" && !contains(f.Origins, site) {
+				f.Origins = append([]string{site}, f.Origins...)
+			}
+
+			// Whether ReplyTo and ReplyToName were explicitly marked,
+			// rather than guessed.
+			markedReplyTo, markedReplyToName := false, false
+
+			// Names that an element such as a text field or a hidden
+			// input submits too, and so can have any value.
+			anyValue := map[string]bool{}
+
 			// All of these are submittable according to
 			//     https://developer.mozilla.org/en-US/docs/Web/Guide/HTML/Content_categories#Form_submittable
 			sel.Find(
 				"button, input, keygen, object, select, textarea",
-			).Each(func(_ int, submittable *goquery.Selection) {
+			).EachWithBreak(func(_ int, submittable *goquery.Selection) bool {
 				name, ok := submittable.Attr("name")
 				if !ok { // skip elements without names
-					return
+					return true
 				}
 
+				seen := contains(f.Fields, name) || contains(f.Files, name)
 				if submittable.Is("input[type='file']") {
-					f.Files = append(f.Files, name)
+					f.Files = appendUnique(f.Files, name)
 				} else {
-					f.Fields = append(f.Fields, name)
+					f.Fields = appendUnique(f.Fields, name)
+				}
+
+				if _, ok := submittable.Attr("multiple"); ok && submittable.Is("select, input[type='file']") {
+					f.Multiple[name] = true
+				} else if seen && !submittable.Is("input[type='radio']") {
+					// Every element sharing a name is submitted, except
+					// for radio buttons where only the checked one is.
+					f.Multiple[name] = true
+				}
+
+				if _, ok := submittable.Attr("data-formsink-reply-to"); ok && !markedReplyTo {
+					f.ReplyTo, markedReplyTo = name, true
+				} else if f.ReplyTo == "" && submittable.Is("input[type='email']") {
+					f.ReplyTo = name
 				}
+				if _, ok := submittable.Attr("data-formsink-reply-to-name"); ok && !markedReplyToName {
+					f.ReplyToName, markedReplyToName = name, true
+				} else if f.ReplyToName == "" && submittable.AttrOr("autocomplete", "") == "name" {
+					f.ReplyToName = name
+				}
+
+				option := submittable.Is("input[type='radio'], input[type='checkbox']")
+				if !option && !submittable.Is("select") {
+					anyValue[name] = true
+				}
+				if !seen {
+					if label := labelText(doc, submittable); label != "" {
+						f.Labels[name] = label
+					}
+					if legend := legendText(sel, submittable); legend != "" {
+						f.Legends[name] = legend
+					}
+				} else if option {
+					// The <label>s of a radio or checkbox group describe
+					// each option rather than the group, which is usually
+					// described by its <legend> instead.
+					if _, ok := submittable.Attr("aria-label"); !ok {
+						delete(f.Labels, name)
+					}
+				}
+
+				var c *Constraint
+				c, err = selectionToConstraint(submittable)
+				if err != nil {
+					return false
+				}
+				if c != nil {
+					if prev, ok := f.Constraints[name]; ok {
+						// e.g. a radio group where only one button is marked required
+						prev.merge(c)
+					} else {
+						f.Constraints[name] = c
+					}
+				}
+				return true
 			})
+			if err != nil {
+				return false
+			}
+
+			// e.g. a checkbox after a hidden input submitting "no" when
+			// it's unchecked, or a radio group with an "other" text field
+			for name := range anyValue {
+				if c, ok := f.Constraints[name]; ok {
+					c.Options = nil
+				}
+			}
 
 			forms = append(forms, f)
 			return true
@@ -74,3 +364,141 @@ func documentsToForms(documents ...*goquery.Document) ([]*Form, error) {
 
 	return forms, nil
 }
+
+// labelText finds the human-readable name of a submittable element: the
+// text of a <label for='id'> or of a wrapping <label>, or else its
+// aria-label or placeholder attribute.
+func labelText(doc *goquery.Document, submittable *goquery.Selection) string {
+	if id, ok := submittable.Attr("id"); ok && id != "" {
+		label := doc.Find("label").FilterFunction(func(_ int, l *goquery.Selection) bool {
+			return l.AttrOr("for", "") == id
+		}).First()
+		if text := cleanText(label); text != "" {
+			return text
+		}
+	}
+
+	if text := cleanText(submittable.Closest("label")); text != "" {
+		return text
+	}
+
+	for _, attr := range []string{"aria-label", "placeholder"} {
+		if text := strings.Join(strings.Fields(submittable.AttrOr(attr, "")), " "); text != "" {
+			return text
+		}
+	}
+
+	return ""
+}
+
+// legendText joins the legends of every <fieldset> between form and
+// submittable, outermost first.
+func legendText(form, submittable *goquery.Selection) string {
+	legends := []string{}
+	submittable.ParentsUntilSelection(form).Filter("fieldset").Each(func(_ int, fieldset *goquery.Selection) {
+		if legend := cleanText(fieldset.ChildrenFiltered("legend").First()); legend != "" {
+			// Parents are innermost first, so prepend.
+			legends = append([]string{legend}, legends...)
+		}
+	})
+	return strings.Join(legends, " > ")
+}
+
+// cleanText returns the text of sel, leaving out any form controls inside
+// of it (e.g. the <option>s of a wrapped <select>) and collapsing
+// whitespace. Trailing colons and asterisks, as in "Email: *", are
+// dropped.
+func cleanText(sel *goquery.Selection) string {
+	if sel.Length() == 0 {
+		return ""
+	}
+	clone := sel.Clone()
+	clone.Find("button, input, keygen, object, select, textarea").Remove()
+	text := strings.Join(strings.Fields(clone.Text()), " ")
+	return strings.TrimRight(text, " :*")
+}
+
+// readSettings reads the data-formsink-* attributes of a <form> into f.
+func readSettings(f *Form, sel *goquery.Selection) error {
+	f.Redirect = sel.AttrOr("data-formsink-redirect", "")
+	f.ErrorRedirect = sel.AttrOr("data-formsink-error-redirect", "")
+	f.Subject = sel.AttrOr("data-formsink-subject", "")
+	f.Template = sel.AttrOr("data-formsink-template", "")
+
+	if folder, ok := sel.Attr("data-formsink-folder"); ok {
+		if !validFolder(folder) {
+			return e("invalid 'data-formsink-folder' attribute %q on form %q", folder, f.Name)
+		}
+		f.Folder = folder
+	}
+
+	if list, ok := sel.Attr("data-formsink-origins"); ok {
+		origins, err := parseOrigins(strings.Fields(list))
+		if err != nil {
+			return e("invalid 'data-formsink-origins' attribute %q on form %q", list, f.Name)
+		}
+		f.Origins = origins
+	}
+
+	for attr, dst := range map[string]*[]mail.Address{
+		"data-formsink-to":  &f.To,
+		"data-formsink-cc":  &f.Cc,
+		"data-formsink-bcc": &f.Bcc,
+	} {
+		list, ok := sel.Attr(attr)
+		if !ok {
+			continue
+		}
+		addresses, err := mail.ParseAddressList(list)
+		if err != nil {
+			return e("invalid '%s' attribute %q on form %q: %v", attr, list, f.Name, err)
+		}
+		for _, a := range addresses {
+			*dst = append(*dst, *a)
+		}
+	}
+
+	for attr, dst := range map[string]*int64{
+		"data-formsink-max-size":       &f.MaxSize,
+		"data-formsink-max-file-size":  &f.MaxFileSize,
+		"data-formsink-max-field-size": &f.MaxFieldSize,
+	} {
+		size, ok := sel.Attr(attr)
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n <= 0 {
+			return e("invalid '%s' attribute %q on form %q", attr, size, f.Name)
+		}
+		*dst = n
+	}
+
+	if files, ok := sel.Attr("data-formsink-max-files"); ok {
+		n, err := strconv.Atoi(files)
+		if err != nil || n <= 0 {
+			return e("invalid 'data-formsink-max-files' attribute %q on form %q", files, f.Name)
+		}
+		f.MaxFiles = n
+	}
+
+	return nil
+}
+
+// appendUnique appends name unless it is already present, since several
+// elements such as the buttons of a radio group can share one name.
+func appendUnique(names []string, name string) []string {
+	if contains(names, name) {
+		return names
+	}
+	return append(names, name)
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -1,7 +1,10 @@
 package lib
 
 import (
+	"mime/multipart"
+	"net/mail"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/PuerkitoBio/goquery"
@@ -47,3 +50,301 @@ func TestDocumentsToFormsNoAction(t *testing.T) {
 		assert.NotNil(t, err)
 	}
 }
+
+func TestDocumentsToFormsConstraints(t *testing.T) {
+	html := `<form action='/signup'>
+		<input name='email' type='email' required>
+		<input name='age' type='number' min='18' max='130'>
+		<input name='handle' minlength='2' maxlength='16' pattern='[a-z]+'>
+		<input name='plan' type='radio' value='free'>
+		<input name='plan' type='radio' value='paid' required>
+		<input name='cv' type='file' required>
+		<textarea name='bio'></textarea>
+	</form>`
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	require.Nil(t, err)
+
+	forms, err := documentsToForms(doc)
+	require.Nil(t, err)
+	require.Len(t, forms, 1)
+
+	assert.Equal(t, map[string]*Constraint{
+		"email":  &Constraint{Required: true, Type: "email"},
+		"age":    &Constraint{Type: "number", Min: "18", Max: "130"},
+		"handle": &Constraint{MinLength: 2, MaxLength: 16, Pattern: "[a-z]+"},
+		"plan":   &Constraint{Required: true, Options: []string{"free", "paid"}},
+		"cv":     &Constraint{Required: true},
+	}, forms[0].Constraints)
+}
+
+func TestDocumentsToFormsBadConstraint(t *testing.T) {
+	inputs := []string{
+		`<input name='a' maxlength='many'>`,
+		`<input name='a' minlength='-1'>`,
+	}
+
+	for _, input := range inputs {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(
+			"<form action='/a'>" + input + "</form>"))
+		require.Nil(t, err)
+
+		_, err = documentsToForms(doc)
+		assert.NotNil(t, err, input)
+	}
+}
+
+// Patterns that Go can't compile are ignored, as browsers do with those
+// they can't compile.
+func TestDocumentsToFormsUnsupportedPattern(t *testing.T) {
+	html := `<form action='/a'>
+		<input name='password' pattern='(?=.*\d).{8,}' required>
+		<input name='broken' pattern='(['>
+	</form>`
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	require.Nil(t, err)
+
+	forms, err := documentsToForms(doc)
+	require.Nil(t, err)
+	require.Len(t, forms, 1)
+	assert.Equal(t, &Constraint{Required: true}, forms[0].Constraints["password"])
+	assert.Equal(t, "", forms[0].Constraints["broken"].Pattern)
+	assert.Empty(t, forms[0].validate(&multipart.Form{Value: map[string][]string{"password": {"x"}, "broken": {"y"}}}))
+}
+
+func TestDocumentsToFormsOptions(t *testing.T) {
+	html := `<form action='/contact'>
+		<select name='department'>
+			<option value='sales'>Sales</option>
+			<option>Support</option>
+		</select>
+		<input name='topic' type='radio' value='billing'>
+		<input name='topic' type='radio' value='other'>
+		<input name='subscribe' type='checkbox'>
+	</form>`
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	require.Nil(t, err)
+
+	forms, err := documentsToForms(doc)
+	require.Nil(t, err)
+	require.Len(t, forms, 1)
+
+	assert.Equal(t, []string{"department", "topic", "subscribe"}, forms[0].Fields)
+	assert.Equal(t, map[string]*Constraint{
+		"department": &Constraint{Options: []string{"sales", "Support"}},
+		"topic":      &Constraint{Options: []string{"billing", "other"}},
+		"subscribe":  &Constraint{Options: []string{"on"}},
+	}, forms[0].Constraints)
+}
+
+// Names that are also submitted by elements taking any value, such as a
+// hidden fallback for a checkbox or a text field for an "other" option,
+// aren't limited to the options.
+func TestDocumentsToFormsOptionsAnyValue(t *testing.T) {
+	html := `<form action='/contact'>
+		<input name='agree' type='hidden' value='no'>
+		<input name='agree' type='checkbox' value='yes'>
+		<input name='topic' type='radio' value='billing' required>
+		<input name='topic' type='radio' value='support'>
+		<input name='topic' type='text'>
+		<input name='plan' type='radio' value='free'>
+		<input name='plan' type='radio' value='paid'>
+	</form>`
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	require.Nil(t, err)
+
+	forms, err := documentsToForms(doc)
+	require.Nil(t, err)
+	require.Len(t, forms, 1)
+
+	assert.Equal(t, map[string]*Constraint{
+		"agree": &Constraint{},
+		"topic": &Constraint{Required: true},
+		"plan":  &Constraint{Options: []string{"free", "paid"}},
+	}, forms[0].Constraints)
+	assert.Empty(t, forms[0].validate(&multipart.Form{Value: map[string][]string{
+		"agree": {"no"},
+		"topic": {"something else"},
+		"plan":  {"free"},
+	}}))
+}
+
+func TestDocumentsToFormsMultiple(t *testing.T) {
+	html, err := os.Open("../resources/survey.html")
+	require.Nil(t, err)
+	defer html.Close()
+
+	doc, err := goquery.NewDocumentFromReader(html)
+	require.Nil(t, err)
+
+	forms, err := documentsToForms(doc)
+	require.Nil(t, err)
+	require.Len(t, forms, 1)
+
+	assert.Equal(t, []string{"name", "interests", "languages"}, forms[0].Fields)
+	assert.Equal(t, []string{"photos"}, forms[0].Files)
+	assert.Equal(t, map[string]bool{
+		"interests": true,
+		"languages": true,
+		"photos":    true,
+	}, forms[0].Multiple)
+}
+
+func TestDocumentsToFormsSettings(t *testing.T) {
+	html := `<form action='/contact'
+		data-formsink-redirect='https://vczf.io/thanks'
+		data-formsink-error-redirect='https://vczf.io/oops'
+		data-formsink-subject='New contact request'
+		data-formsink-to='Sales <sales@vczf.io>, support@vczf.io'
+		data-formsink-cc='archive@vczf.io'
+		data-formsink-bcc='audit@vczf.io'
+		data-formsink-max-size='1048576'
+		data-formsink-max-file-size='524288'
+		data-formsink-max-files='3'
+		data-formsink-max-field-size='4096'
+		data-formsink-template='contact.tmpl'
+		data-formsink-folder='forms.contact'
+		data-formsink-origins='https://vczf.io HTTPS://www.vczf.io:443'>
+		<input name='name'>
+	</form>`
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	require.Nil(t, err)
+
+	forms, err := documentsToForms(doc)
+	require.Nil(t, err)
+	require.Len(t, forms, 1)
+
+	f := forms[0]
+	assert.Equal(t, "https://vczf.io/thanks", f.Redirect)
+	assert.Equal(t, "https://vczf.io/oops", f.ErrorRedirect)
+	assert.Equal(t, "New contact request", f.Subject)
+	assert.Equal(t, []mail.Address{
+		mail.Address{Name: "Sales", Address: "sales@vczf.io"},
+		mail.Address{Address: "support@vczf.io"},
+	}, f.To)
+	assert.Equal(t, []mail.Address{mail.Address{Address: "archive@vczf.io"}}, f.Cc)
+	assert.Equal(t, []mail.Address{mail.Address{Address: "audit@vczf.io"}}, f.Bcc)
+	assert.Equal(t, int64(1048576), f.MaxSize)
+	assert.Equal(t, int64(524288), f.MaxFileSize)
+	assert.Equal(t, 3, f.MaxFiles)
+	assert.Equal(t, int64(4096), f.MaxFieldSize)
+	assert.Equal(t, "contact.tmpl", f.Template)
+	assert.Equal(t, "forms.contact", f.Folder)
+	assert.Equal(t, []string{"https://vczf.io", "https://www.vczf.io"}, f.Origins)
+}
+
+// A form may be submitted from the site its page is published on.
+func TestDocumentsToFormsPageOrigin(t *testing.T) {
+	html := `<link rel='canonical' href='https://vczf.io/contact.html'>
+	<form action='/contact' data-formsink-origins='https://partner.example.net'></form>
+	<form action='/survey' data-formsink-origins='https://vczf.io'></form>`
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	require.Nil(t, err)
+
+	forms, err := documentsToForms(doc)
+	require.Nil(t, err)
+	require.Len(t, forms, 2)
+	assert.Equal(t, []string{"https://vczf.io", "https://partner.example.net"}, forms[0].Origins)
+	assert.Equal(t, []string{"https://vczf.io"}, forms[1].Origins)
+}
+
+func TestDocumentsToFormsBadSettings(t *testing.T) {
+	attrs := []string{
+		`data-formsink-to='not an address'`,
+		`data-formsink-bcc='a@b.c; d'`,
+		`data-formsink-max-size='1MB'`,
+		`data-formsink-max-size='0'`,
+		`data-formsink-max-file-size='-1'`,
+		`data-formsink-max-files='many'`,
+		`data-formsink-max-field-size='4k'`,
+		`data-formsink-folder='../contact'`,
+		`data-formsink-folder='.contact'`,
+		`data-formsink-folder=''`,
+		`data-formsink-origins='vczf.io'`,
+		`data-formsink-origins='https://vczf.io null'`,
+	}
+
+	for _, attr := range attrs {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(
+			"<form action='/a' " + attr + "></form>"))
+		require.Nil(t, err)
+
+		_, err = documentsToForms(doc)
+		assert.NotNil(t, err, attr)
+	}
+}
+
+func TestDocumentsToFormsLabels(t *testing.T) {
+	html := `<label for='msg'>Your message:</label>
+	<form action='/order'>
+		<textarea id='msg' name='msg_body_2'>default text</textarea>
+		<fieldset>
+			<legend>Shipping address</legend>
+			<label>Street * <input name='street'></label>
+			<input name='zip' placeholder='  Postal   code '>
+			<fieldset>
+				<legend>Delivery</legend>
+				<label><input type='radio' name='speed' value='slow'> Slow</label>
+				<label><input type='radio' name='speed' value='fast'> Fast</label>
+			</fieldset>
+		</fieldset>
+		<label>Gift wrap <input type='checkbox' name='gift'></label>
+		<label>Country
+			<select name='country' aria-label='ignored'><option>Canada</option></select>
+		</label>
+		<input name='coupon' aria-label='Coupon code' placeholder='ABC-123'>
+		<input name='nolabel'>
+	</form>`
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	require.Nil(t, err)
+
+	forms, err := documentsToForms(doc)
+	require.Nil(t, err)
+	require.Len(t, forms, 1)
+
+	assert.Equal(t, map[string]string{
+		"msg_body_2": "Your message",
+		"street":     "Street",
+		"zip":        "Postal code",
+		"gift":       "Gift wrap",
+		"country":    "Country",
+		"coupon":     "Coupon code",
+	}, forms[0].Labels)
+	assert.Equal(t, map[string]string{
+		"street": "Shipping address",
+		"zip":    "Shipping address",
+		"speed":  "Shipping address > Delivery",
+	}, forms[0].Legends)
+}
+
+func TestDocumentsToFormsReplyTo(t *testing.T) {
+	cases := []struct {
+		html                 string
+		replyTo, replyToName string
+	}{
+		{`<input name='a' type='email'><input name='b' type='email'>`, "a", ""},
+		{`<input name='a' type='email'><input name='b' data-formsink-reply-to>`, "b", ""},
+		{`<input name='a' data-formsink-reply-to><input name='b' data-formsink-reply-to>`, "a", ""},
+		{`<input name='n' autocomplete='name'><input name='e' type='email'>`, "e", "n"},
+		{`<input name='a' autocomplete='name'><input name='b' data-formsink-reply-to-name>`, "", "b"},
+		{`<input name='a'>`, "", ""},
+	}
+
+	for _, c := range cases {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(
+			"<form action='/a'>" + c.html + "</form>"))
+		require.Nil(t, err)
+
+		forms, err := documentsToForms(doc)
+		require.Nil(t, err)
+		require.Len(t, forms, 1)
+		assert.Equal(t, c.replyTo, forms[0].ReplyTo, c.html)
+		assert.Equal(t, c.replyToName, forms[0].ReplyToName, c.html)
+	}
+}
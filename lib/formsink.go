@@ -2,12 +2,16 @@ package lib
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/mail"
-	"os"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/Sirupsen/logrus"
@@ -16,200 +20,665 @@ import (
 
 const DefaultMaildirPath = "./Maildir/"
 
+// formHeader names the form a message was submitted through, for
+// depositors that store each form's messages separately.
+const formHeader = "X-Formsink-Form"
+
+// folderHeader names the Maildir++ folder a message is delivered into, if
+// its form has one.
+const folderHeader = "X-Formsink-Folder"
+
+// submissionHeader holds the ID of the submission a message was built
+// from, which is also in the JSON response to it.
+const submissionHeader = "X-Formsink-Submission"
+
 // This is the same default as in net/http/request.go
 const defaultMaxMemory = 32 << 20 // 32MB
 
-var hostname string
-var formSinkAddress mail.Address
+type formSink struct {
+	depositor Depositor
+	config    Config
+	forms     map[string]*Form
+	templates map[string]*messageTemplate // By form name
+	origins   []string                    // Config.AllowedOrigins, parsed
+	cors      []string                    // Config.CORSOrigins, parsed
+	checks    []Check
+	token     *tokenCheck  // nil unless tokens are required
+	limiter   *rateLimiter // nil unless submissions are rate limited
+}
 
-func init() {
-	var err error
-	hostname, err = os.Hostname()
+func NewSink(config Config, forms ...*Form) (http.Handler, error) {
+	config = config.withDefaults()
+	depositor, err := newConfigDepositor(config)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"err": err,
-		}).Warn("Couldn't read hostname")
+		return nil, err
+	}
+	return newSink(depositor, config, forms...)
+}
 
-		hostname = "example.com"
+func NewSinkFromReader(config Config, readers ...io.Reader) (http.Handler, error) {
+	config = config.withDefaults()
+	depositor, err := newConfigDepositor(config)
+	if err != nil {
+		return nil, err
 	}
+	return newSinkFromReader(depositor, config, readers...)
+}
 
-	formSinkAddress = mail.Address{
-		Name:    "FormSink",
-		Address: "FormSink@" + hostname,
+// NewSinkWithDepositor is like NewSink, but hands submissions to d instead
+// of delivering them as config describes.
+func NewSinkWithDepositor(d Depositor, config Config, forms ...*Form) (http.Handler, error) {
+	if d == nil {
+		return nil, e("depositor cannot be nil")
 	}
+	return newSink(d, config, forms...)
 }
 
-type formSink struct {
-	depositor depositor
-	redirect  string
-	forms     map[string]*Form
+// NewSinkWithDepositorFromReader is like NewSinkFromReader, but hands
+// submissions to d instead of delivering them as config describes.
+func NewSinkWithDepositorFromReader(d Depositor, config Config, readers ...io.Reader) (http.Handler, error) {
+	if d == nil {
+		return nil, e("depositor cannot be nil")
+	}
+	return newSinkFromReader(d, config, readers...)
+}
+
+// newConfigDepositor builds the depositor described by config: a fan-out
+// if it delivers to more than one target. Each target has a spool of its
+// own if there is one, so that targets are retried separately.
+func newConfigDepositor(config Config) (Depositor, error) {
+	names := config.Deliver
+	if len(names) == 0 {
+		names = []string{defaultTarget(config)}
+	}
+	for _, name := range config.BestEffort {
+		if !contains(names, name) {
+			return nil, e("best-effort target %q isn't delivered to", name)
+		}
+	}
+
+	targets := make([]fanoutTarget, 0, len(names))
+	for _, name := range names {
+		targetConfig := config
+		if config.Spool.Dir != "" && len(names) > 1 {
+			targetConfig.Spool.Dir = filepath.Join(config.Spool.Dir, spoolName(name))
+		}
+		d, err := newTargetDepositor(targetConfig, name)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, fanoutTarget{targetName(name), d, !contains(config.BestEffort, name)})
+	}
+
+	if len(targets) == 1 {
+		return targets[0].depositor, nil
+	}
+	return newFanoutDepositor(targets...), nil
 }
 
-func NewSink(maildir, redirect string, forms ...*Form) (http.Handler, error) {
-	return newSink(newMaildirDepositor(maildir), redirect, forms...)
+// defaultTarget is where messages are delivered without Config.Deliver:
+// the first of a webhook, SMTP, LMTP, IMAP, exec and mbox that is
+// configured, or else the maildir.
+func defaultTarget(config Config) string {
+	switch {
+	case config.Webhook.URL != "":
+		return "webhook"
+	case config.SMTP.Addr != "":
+		return "smtp"
+	case config.LMTP.Addr != "":
+		return "lmtp"
+	case config.IMAP.Addr != "":
+		return "imap"
+	case len(config.Exec.Command) > 0:
+		return "exec"
+	case config.Mbox != "":
+		return "mbox"
+	}
+	return "maildir"
 }
 
-func NewSinkFromReader(maildir, redirect string, readers ...io.Reader) (http.Handler, error) {
-	documents := make([]*goquery.Document, 0)
+// newTargetDepositor builds the depositor for one of the targets of
+// Config.Deliver, which is either the name of one configured by config or
+// a URL for OpenDepositor. Messages are encrypted if there are PGPKeys,
+// before they're spooled if there is a spool.
+func newTargetDepositor(config Config, name string) (Depositor, error) {
+	var base Depositor
+	var err error
+	switch name {
+	case "webhook":
+		base, err = newWebhookDepositor(config.Webhook)
+	case "smtp":
+		base, err = newSMTPDepositor(config.SMTP)
+	case "lmtp":
+		base, err = newLMTPDepositor(config.LMTP)
+	case "imap":
+		base, err = newIMAPDepositor(config.IMAP)
+	case "exec":
+		base, err = newExecDepositor(config.Exec)
+	case "mbox":
+		if config.Mbox == "" {
+			return nil, e("missing mbox path")
+		}
+		base, err = newMboxDepositor(config.Mbox, config.MboxPerForm)
+	case "maildir":
+		base, err = newMaildirDepositor(config.Maildir, config.MaildirFolders)
+	default:
+		if !strings.Contains(name, ":") {
+			return nil, e("unknown delivery target %q", name)
+		}
+		base, err = OpenDepositor(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := base.(RawDepositor); !ok && len(config.PGPKeys) > 0 {
+		return nil, e("can't encrypt submissions delivered to %s", targetName(name))
+	}
+	if config.Spool.Dir != "" {
+		if base, err = newSpoolDepositor(config.Spool, base); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(config.PGPKeys) == 0 {
+		return base, nil
+	}
+	keys, err := readArmoredKeys(config.PGPKeys...)
+	if err != nil {
+		return nil, err
+	}
+	return newPGPDepositor(base.(RawDepositor), keys), nil
+}
+
+// targetName is how a target of Config.Deliver appears in logs and errors.
+// URLs lose any password and their whole query, which may hold secrets
+// such as a webhook's.
+func targetName(name string) string {
+	colon := strings.Index(name, ":")
+	if colon < 0 {
+		return name
+	}
+	u, err := url.Parse(name)
+	if err != nil {
+		return name[:colon] + ":…"
+	}
+	u.RawQuery, u.ForceQuery, u.Fragment = "", false, ""
+	if _, ok := u.User.Password(); ok {
+		return u.Redacted()
+	}
+	return u.String()
+}
+
+func newSinkFromReader(depositor Depositor, config Config, readers ...io.Reader) (http.Handler, error) {
+	forms := make([]*Form, 0)
 	for _, r := range readers {
 		d, err := goquery.NewDocumentFromReader(r)
 		if err != nil {
 			return nil, err
 		}
-		documents = append(documents, d)
+		documentForms, err := documentsToForms(d)
+		if err != nil {
+			return nil, err
+		}
+
+		// Pages read from files, e.g. an *os.File, name templates
+		// relative to themselves.
+		if file, ok := r.(interface{ Name() string }); ok {
+			for _, f := range documentForms {
+				if f.Template != "" && !filepath.IsAbs(f.Template) {
+					f.Template = filepath.Join(filepath.Dir(file.Name()), f.Template)
+				}
+			}
+		}
+		forms = append(forms, documentForms...)
 	}
-	return newSinkFromDocument(newMaildirDepositor(maildir), redirect, documents...)
+	return newSink(depositor, config, forms...)
 }
 
-func newSink(depositor depositor, redirect string, forms ...*Form) (http.Handler, error) {
+func newSink(depositor Depositor, config Config, forms ...*Form) (http.Handler, error) {
 	if len(forms) < 1 {
 		return nil, e("must have at least one form")
 	}
-	if redirect == "" {
+	config = config.withDefaults()
+	if config.Redirect == "" {
 		logrus.Warn("'--redirect' is not set")
 	} else {
-		logrus.WithFields(logrus.Fields{"address": redirect}).Info("Redirecting to")
+		logrus.WithFields(logrus.Fields{"address": config.Redirect}).Info("Redirecting to")
 	}
 
 	formMap := make(map[string]*Form)
+	templates := make(map[string]*messageTemplate)
 	for _, f := range forms {
 		if f == nil {
 			return nil, e("forms cannot be nil")
 		} else if f.Name == "" {
 			return nil, e("Form.Name must not be \"\"")
 		}
+		// The fields formsink checks itself aren't part of messages.
+		f = f.withoutFields(config.Honeypot, TokenField)
 		formMap[f.Name] = f
+
+		if f.Template != "" {
+			t, err := loadTemplate(f.Template)
+			if err != nil {
+				return nil, err
+			}
+			templates[f.Name] = t
+		}
+
 		logrus.WithFields(logrus.Fields{
 			"form": f,
 		}).Info("Added form")
 	}
 
-	return &formSink{depositor, redirect, formMap}, nil
-}
+	origins, err := parseOrigins(config.AllowedOrigins)
+	if err != nil {
+		return nil, err
+	}
 
-func newSinkFromDocument(depositor depositor, redirect string, documents ...*goquery.Document) (http.Handler, error) {
-	forms, err := documentsToForms(documents...)
+	cors, err := parseOrigins(config.CORSOrigins)
 	if err != nil {
 		return nil, err
 	}
-	return newSink(depositor, redirect, forms...)
+
+	fs := &formSink{depositor: depositor, config: config, forms: formMap, templates: templates, origins: origins, cors: cors}
+	if config.Honeypot != "" {
+		fs.checks = append(fs.checks, &honeypotCheck{config.Honeypot})
+	}
+	if len(config.Token.Secret) > 0 {
+		fs.token = &tokenCheck{config.Token}
+		fs.checks = append(fs.checks, fs.token)
+	}
+	fs.checks = append(fs.checks, config.Checks...)
+
+	limiter, err := newRateLimiter(config.RateLimit)
+	if err != nil {
+		return nil, err
+	}
+	if limiter.enabled() {
+		fs.limiter = limiter
+	}
+	return fs, nil
 }
 
 func (fs *formSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.allowCORS(w, r)
+
+	// Absolute request URIs such as "http://example.com" have no path.
+	form, ok := fs.forms[strings.TrimPrefix(r.URL.Path, "/")]
+
+	if r.Method == http.MethodGet && fs.token != nil && ok {
+		fs.token.serveToken(w, form)
+		return
+	}
+
+	if r.Method == http.MethodOptions && ok {
+		fs.servePreflight(w, r)
+		return
+	}
+
 	if r.Method != http.MethodPost {
-		writeStatus(w, http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed)
 		return
 	}
 
-	form, ok := fs.forms[r.URL.Path[1:]] // Path starts with '/'
 	if !ok {
-		writeStatus(w, http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound)
 		return
 	}
 
-	if err := r.ParseMultipartForm(defaultMaxMemory); err != nil {
+	if err := checkOrigin(r, form, fs.origins); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"form":  form.Name,
+			"addr":  r.RemoteAddr,
+			"error": err.Error(),
+		}).Warn("Rejecting cross-site submission")
+		fs.fail(w, r, form, http.StatusForbidden)
+		return
+	}
+
+	if fs.limiter != nil {
+		client := fs.limiter.clientIP(r)
+		if ok, wait := fs.limiter.allow(client, form.Name); !ok {
+			logrus.WithFields(logrus.Fields{
+				"form":   form.Name,
+				"client": client,
+			}).Warn("Rate limiting submissions")
+			writeRetryAfter(w, r, wait)
+			return
+		}
+	}
+
+	limits := fs.config.Limits.forForm(form)
+	if limits.MaxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBodySize)
+	}
+
+	// Dropped submissions get an ID too, so that bots can't tell.
+	id, err := newID()
+	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err.Error(),
-		}).Error("Error parsing multipart form")
+		}).Error("Error generating a submission ID")
+		fs.fail(w, r, form, http.StatusInternalServerError)
 		return
 	}
 
-	msg := buildMessage(form, r.MultipartForm)
+	submission, status, err := parseSubmission(r, limits)
+	var exceeded *limitError
+	if errors.As(err, &exceeded) {
+		logrus.WithFields(logrus.Fields{
+			"form":  form.Name,
+			"error": err.Error(),
+		}).Warn("Rejecting oversized submission")
+		fs.fail(w, r, form, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Error parsing form submission")
+		fs.fail(w, r, form, status)
+		return
+	}
+	// Uploads that didn't fit in memory are in temporary files.
+	defer submission.RemoveAll()
 
-	if err := fs.depositor.Deposit(msg); err != nil {
+	if err := limits.check(submission); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"form":  form.Name,
+			"error": err.Error(),
+		}).Warn("Rejecting oversized submission")
+		fs.fail(w, r, form, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	for _, check := range fs.checks {
+		if err := check.Check(r, form, submission); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"form":  form.Name,
+				"addr":  r.RemoteAddr,
+				"error": err.Error(),
+			}).Warn("Dropping suspected spam")
+			fs.succeed(w, r, form, id)
+			return
+		}
+	}
+
+	if errs := form.validate(submission); len(errs) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"form":   form.Name,
+			"errors": errs,
+		}).Warn("Rejecting invalid submission")
+		if wantsJSON(r) {
+			writeFieldErrorsJSON(w, errs)
+		} else if form.ErrorRedirect != "" {
+			fs.fail(w, r, form, http.StatusBadRequest)
+		} else {
+			writeFieldErrors(w, errs)
+		}
+		return
+	}
+
+	msg := buildMessage(&fs.config, form, submission)
+	defer closeAttachments(msg)
+	msg.Headers[submissionHeader] = []string{id}
+	data := newTemplateData(form, submission, r)
+	data.Request.ID = id
+
+	if t, ok := fs.templates[form.Name]; ok {
+		if err := t.render(msg, data); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"form":  form.Name,
+				"error": err.Error(),
+			}).Error("Error rendering message template")
+			fs.fail(w, r, form, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := fs.depositor.Deposit(r.Context(), &Submission{msg, data}); err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err.Error(),
 		}).Error("Error while building and saving the message")
-		writeStatus(w, http.StatusInternalServerError)
+		fs.fail(w, r, form, depositStatus(err))
 		return
 	}
 
-	if fs.redirect == "" {
+	fs.succeed(w, r, form, id)
+
+	logrus.WithFields(logrus.Fields{
+		"form": form.Name,
+		"id":   id,
+	}).Info("Finished processing form")
+}
+
+// succeed responds to an accepted submission, redirecting to the form's
+// confirmation page if there is one, or else with its ID if r accepts
+// JSON.
+func (fs *formSink) succeed(w http.ResponseWriter, r *http.Request, form *Form, id string) {
+	redirect := fs.config.Redirect
+	if form.Redirect != "" {
+		redirect = form.Redirect
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, &submissionResponse{Status: "ok", ID: id, Redirect: redirect})
+	} else if redirect == "" {
 		writeStatus(w, http.StatusNoContent)
 	} else {
-		w.Header().Set("Location", fs.redirect)
+		w.Header().Set("Location", redirect)
 		writeStatus(w, http.StatusSeeOther)
 	}
+}
 
-	logrus.WithFields(logrus.Fields{
-		"form": form.Name,
-	}).Info("Finished processing form")
+// depositStatus is the response status for a message that couldn't be
+// deposited: 503 Service Unavailable if trying again later may work, such
+// as after a 4xx reply from a mail server, or else 500.
+func depositStatus(err error) int {
+	if isTemporary(err) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// fail responds to a submission that could not be accepted, redirecting to
+// the form's error page if it has one, unless r accepts JSON.
+func (fs *formSink) fail(w http.ResponseWriter, r *http.Request, form *Form, status int) {
+	if wantsJSON(r) {
+		writeJSON(w, status, &submissionResponse{
+			Status:   "error",
+			Redirect: form.ErrorRedirect,
+			Error:    http.StatusText(status),
+		})
+		return
+	}
+	if form.ErrorRedirect == "" {
+		writeStatus(w, status)
+		return
+	}
+	w.Header().Set("Location", form.ErrorRedirect)
+	writeStatus(w, http.StatusSeeOther)
 }
 
-func buildMessage(formSpec *Form, multipartForm *multipart.Form) *gophermail.Message {
+func buildMessage(config *Config, formSpec *Form, multipartForm *multipart.Form) *gophermail.Message {
 	// Begin building the message.
 	msg := &gophermail.Message{
-		From: formSinkAddress,
+		From: config.From,
 		To: []mail.Address{mail.Address{
 			// e.g. contact@example.com
-			Address: formSpec.Name + "@" + hostname,
+			Address: formSpec.Name + "@" + config.Domain,
 		}},
+		Cc:          formSpec.Cc,
+		Bcc:         formSpec.Bcc,
 		Subject:     formSpec.Name + " request",
 		Attachments: make([]gophermail.Attachment, 0, 0),
+		Headers:     mail.Header{formHeader: {formSpec.Name}},
+	}
+	if formSpec.Folder != "" {
+		msg.Headers[folderHeader] = []string{formSpec.Folder}
+	}
+	if len(formSpec.To) > 0 {
+		msg.To = formSpec.To
+	} else if to := config.To[formSpec.Name]; len(to) > 0 {
+		msg.To = to
+	}
+	if len(msg.Cc) == 0 {
+		msg.Cc = config.Cc[formSpec.Name]
+	}
+	if len(msg.Bcc) == 0 {
+		msg.Bcc = config.Bcc[formSpec.Name]
+	}
+	if formSpec.Subject != "" {
+		msg.Subject = formSpec.Subject
+	}
+
+	if replyTo, ok := replyToAddress(formSpec, multipartForm); ok {
+		msg.ReplyTo = replyTo
 	}
 
 	// Build message body
 	body := &bytes.Buffer{}
 
+	section := ""
 	for _, id := range formSpec.Fields {
-		body.WriteString(id)
-		body.WriteString(": ")
-
-		values, ok := multipartForm.Value[id]
-		if ok && len(values) > 0 {
-			if len(values) > 1 {
-				logrus.WithFields(logrus.Fields{
-					"id": id,
-				}).Warn("Multiple values for a single field, ignoring all but the first")
-			}
-			body.WriteString(values[0])
-
-		} else {
-			logrus.WithFields(logrus.Fields{
-				"id": id,
-			}).Warn("No value for id")
+		if legend := formSpec.Legends[id]; legend != section {
+			writeSection(body, legend)
+			section = legend
 		}
 
-		body.WriteString("\n")
+		for _, value := range fieldValues(formSpec, multipartForm, id) {
+			body.WriteString(formSpec.label(id))
+			body.WriteString(": ")
+			body.WriteString(value)
+			body.WriteString("\n")
+		}
 	}
 
 	msg.Body = body.String()
 
 	// Add files as attachments
 	for _, id := range formSpec.Files {
-		metas, ok := multipartForm.File[id]
-		if !ok || len(metas) < 1 {
-			logrus.WithFields(logrus.Fields{
-				"id": id,
-			}).Warn("No file for id")
-			continue
+		for _, meta := range fileHeaders(formSpec, multipartForm, id) {
+			file, err := meta.Open()
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"id":    id,
+					"error": err.Error(),
+				}).Warn("Error opening file")
+				continue
+			}
+
+			msg.Attachments = append(msg.Attachments,
+				gophermail.Attachment{
+					Name:        meta.Filename,
+					ContentType: meta.Header.Get("Content-Type"),
+					Data:        file,
+				})
 		}
+	}
 
-		if len(metas) > 1 {
-			logrus.WithFields(logrus.Fields{
-				"id": id,
-			}).Warn("Multiple files for a single field, ignoring all but the first")
+	return msg
+}
+
+// closeAttachments closes the uploaded files that buildMessage opened.
+func closeAttachments(msg *gophermail.Message) {
+	for _, a := range msg.Attachments {
+		if closer, ok := a.Data.(io.Closer); ok {
+			closer.Close()
 		}
+	}
+}
 
-		meta := metas[0]
+// replyToAddress builds an address from the submitter's email and name
+// fields. The email must be a bare address, e.g. "crasm@vczf.io", so that
+// the submitter can't sneak in other recipients or headers.
+func replyToAddress(formSpec *Form, multipartForm *multipart.Form) (mail.Address, bool) {
+	if formSpec.ReplyTo == "" {
+		return mail.Address{}, false
+	}
 
-		file, err := meta.Open()
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"id":    id,
-				"error": err.Error(),
-			}).Warn("Error opening file")
-			continue
+	values := multipartForm.Value[formSpec.ReplyTo]
+	if len(values) < 1 || values[0] == "" {
+		return mail.Address{}, false
+	}
+
+	addr, err := mail.ParseAddress(values[0])
+	if err != nil || addr.Name != "" || addr.Address != values[0] {
+		logrus.WithFields(logrus.Fields{
+			"id":    formSpec.ReplyTo,
+			"value": values[0],
+		}).Warn("Ignoring invalid Reply-To address")
+		return mail.Address{}, false
+	}
+
+	if formSpec.ReplyToName != "" {
+		if names := multipartForm.Value[formSpec.ReplyToName]; len(names) > 0 {
+			// Collapsing whitespace removes any line breaks. The name is
+			// otherwise encoded by mail.Address.String as needed.
+			addr.Name = strings.Join(strings.Fields(names[0]), " ")
 		}
+	}
 
-		msg.Attachments = append(msg.Attachments,
-			gophermail.Attachment{
-				Name: id + "_" + meta.Filename,
-				Data: file,
-			})
+	return *addr, true
+}
+
+// fieldValues returns the submitted values of a field, or a single empty
+// value if there are none. Fields that aren't multi-valued keep only their
+// first value.
+func fieldValues(formSpec *Form, multipartForm *multipart.Form, id string) []string {
+	values, ok := multipartForm.Value[id]
+	if !ok || len(values) < 1 {
+		logrus.WithFields(logrus.Fields{
+			"id": id,
+		}).Warn("No value for id")
+		return []string{""}
 	}
 
-	return msg
+	if len(values) > 1 && !formSpec.Multiple[id] {
+		logrus.WithFields(logrus.Fields{
+			"id": id,
+		}).Warn("Multiple values for a single field, ignoring all but the first")
+		return values[:1]
+	}
+
+	return values
+}
+
+// fileHeaders returns the uploaded files of a file field. Fields that
+// aren't multi-valued keep only their first file.
+func fileHeaders(formSpec *Form, multipartForm *multipart.Form, id string) []*multipart.FileHeader {
+	metas, ok := multipartForm.File[id]
+	if !ok || len(metas) < 1 {
+		logrus.WithFields(logrus.Fields{
+			"id": id,
+		}).Warn("No file for id")
+		return nil
+	}
+
+	if len(metas) > 1 && !formSpec.Multiple[id] {
+		logrus.WithFields(logrus.Fields{
+			"id": id,
+		}).Warn("Multiple files for a single field, ignoring all but the first")
+		return metas[:1]
+	}
+
+	return metas
+}
+
+// writeSection starts a new section of the message body for the fields of
+// a <fieldset>, or for fields outside of any fieldset if legend is "".
+func writeSection(body *bytes.Buffer, legend string) {
+	if body.Len() > 0 {
+		body.WriteString("\n")
+	}
+	if legend != "" {
+		body.WriteString(legend)
+		body.WriteString("\n")
+		body.WriteString(strings.Repeat("-", utf8.RuneCountInString(legend)))
+		body.WriteString("\n")
+	}
 }
 
 func writeStatus(w http.ResponseWriter, status int) {
@@ -217,6 +686,31 @@ func writeStatus(w http.ResponseWriter, status int) {
 	fmt.Fprintf(w, "%d", status)
 }
 
+// writeFieldErrors responds with 400 Bad Request followed by one line for
+// each failing field.
+func writeFieldErrors(w http.ResponseWriter, errs []*FieldError) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeStatus(w, http.StatusBadRequest)
+	fmt.Fprintln(w)
+	for _, fe := range errs {
+		fmt.Fprintln(w, fe.Error())
+	}
+}
+
+// writeFieldErrorsJSON responds with 400 Bad Request and the reason each
+// failing field was rejected.
+func writeFieldErrorsJSON(w http.ResponseWriter, errs []*FieldError) {
+	response := &submissionResponse{
+		Status: "error",
+		Error:  http.StatusText(http.StatusBadRequest),
+		Errors: map[string]string{},
+	}
+	for _, fe := range errs {
+		response.Errors[fe.Field] = fe.Reason
+	}
+	writeJSON(w, http.StatusBadRequest, response)
+}
+
 func e(format string, a ...interface{}) error {
 	return fmt.Errorf("formsink: "+format, a...)
 }
@@ -2,7 +2,9 @@ package lib
 
 import (
 	"bufio"
+	"context"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/mail"
@@ -20,6 +22,18 @@ var simpleForm = &Form{
 	Name:   "contact",
 	Fields: []string{"name", "email", "message"},
 	Files:  []string{"picture"},
+	Constraints: map[string]*Constraint{
+		"email": &Constraint{Type: "email"},
+	},
+	Multiple: map[string]bool{},
+	Labels: map[string]string{
+		"name":    "name",
+		"email":   "email",
+		"message": "message",
+		"picture": "picture",
+	},
+	Legends: map[string]string{},
+	ReplyTo: "email",
 }
 
 // This is a function because the attachments are read by the tests. You
@@ -41,6 +55,10 @@ func simpleMessage() *gophermail.Message {
 		Address: simpleForm.Name + "@" + hostname,
 	}}
 
+	msg.ReplyTo = mail.Address{
+		Address: "crasm@formsink.email.vczf.io",
+	}
+
 	msg.Subject = simpleForm.Name + " request"
 
 	tiny, err := os.Open("../resources/tiny.ppm")
@@ -59,20 +77,45 @@ func simpleMessage() *gophermail.Message {
 	return msg
 }
 
+// Makes simpleMessage as it's deposited for the named form, with a Cc and
+// a Bcc recipient too.
+func formMessage(form string) *gophermail.Message {
+	msg := simpleMessage()
+	msg.Subject = form + " request"
+	msg.Headers = mail.Header{formHeader: {form}}
+	msg.Cc = []mail.Address{mail.Address{Address: "archive@vczf.io"}}
+	msg.Bcc = []mail.Address{mail.Address{Address: "audit@vczf.io"}}
+	return msg
+}
+
 type mockDepositor struct {
-	msg *gophermail.Message
+	msg  *gophermail.Message
+	data *TemplateData
 }
 
-func (m *mockDepositor) Deposit(msg *gophermail.Message) error {
-	m.msg = msg
+func (m *mockDepositor) Deposit(ctx context.Context, s *Submission) error {
+	m.msg = s.Message
+	m.data = s.Data
 	return nil
 }
 
+// depositMessage deposits a submission of which only the message is known.
+func depositMessage(d Depositor, msg *gophermail.Message) error {
+	return d.Deposit(context.Background(), &Submission{Message: msg})
+}
+
 // Replays the captured HTTP POST request against the http.Handler and
 // returns the response.
 func post(t *testing.T, sink http.Handler) *http.Response {
-	firefoxPost, err := os.Open("../resources/post")
+	return replay(t, sink, "../resources/post")
+}
+
+// Replays the captured HTTP request in the named file against the
+// http.Handler and returns the response.
+func replay(t *testing.T, sink http.Handler, name string) *http.Response {
+	firefoxPost, err := os.Open(name)
 	require.Nil(t, err)
+	defer firefoxPost.Close()
 	r, err := http.ReadRequest(bufio.NewReader(firefoxPost))
 	require.Nil(t, err)
 
@@ -89,8 +132,10 @@ func checkMessage(t *testing.T, msg *gophermail.Message) {
 	require.NotNil(t, msg, "No mail message was provided")
 	assert.Equal(t, simpleMessage.From, msg.From)
 	assert.Equal(t, simpleMessage.To, msg.To)
+	assert.Equal(t, simpleMessage.ReplyTo, msg.ReplyTo)
 	assert.Equal(t, simpleMessage.Subject, msg.Subject)
 	assert.Equal(t, simpleMessage.Body, msg.Body)
+	assert.Equal(t, simpleForm.Name, msg.Headers.Get(formHeader))
 
 	assert.Equal(t, len(simpleMessage.Attachments), len(msg.Attachments),
 		"Does have the correct number of attachments")
@@ -112,7 +157,7 @@ func checkMessage(t *testing.T, msg *gophermail.Message) {
 func TestHappy(t *testing.T) {
 	mockDepositor := &mockDepositor{}
 
-	sink, err := newSink(mockDepositor, location, simpleForm)
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, simpleForm)
 	require.Nil(t, err)
 
 	result := post(t, sink)
@@ -123,7 +168,7 @@ func TestHappy(t *testing.T) {
 
 func TestNotFound(t *testing.T) {
 	mockDepositor := &mockDepositor{}
-	sink, err := newSink(mockDepositor, location, simpleForm)
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, simpleForm)
 	assert.Nil(t, err)
 
 	r := httptest.NewRequest(http.MethodPost, "/hello", nil)
@@ -142,14 +187,14 @@ func TestAddFormError(t *testing.T) {
 	}
 
 	for _, f := range forms {
-		_, err := newSink(&mockDepositor{}, location, f) // We ignore the depositor msg
+		_, err := newSink(&mockDepositor{}, Config{Redirect: location}, f) // We ignore the depositor msg
 		assert.NotNil(t, err)
 	}
 }
 
 func TestNotPost(t *testing.T) {
 	mockDepositor := &mockDepositor{}
-	sink, err := newSink(mockDepositor, location, simpleForm)
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, simpleForm)
 	assert.Nil(t, err)
 
 	r := httptest.NewRequest(http.MethodGet, "/contact", nil)
@@ -165,7 +210,7 @@ func TestNotPost(t *testing.T) {
 func TestNoRedirect(t *testing.T) {
 	mockDepositor := &mockDepositor{}
 
-	sink, err := newSink(mockDepositor, location, simpleForm)
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, simpleForm)
 	require.Nil(t, err)
 
 	result := post(t, sink)
@@ -173,3 +218,242 @@ func TestNoRedirect(t *testing.T) {
 	assert.Equal(t, location, result.Header.Get("Location"))
 	checkMessage(t, mockDepositor.msg)
 }
+
+func TestInvalid(t *testing.T) {
+	mockDepositor := &mockDepositor{}
+
+	form := &Form{
+		Name:   "contact",
+		Fields: []string{"name", "email", "message", "phone"},
+		Files:  []string{"picture"},
+		Constraints: map[string]*Constraint{
+			"name":  &Constraint{MaxLength: 3},
+			"phone": &Constraint{Required: true},
+		},
+	}
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, form)
+	require.Nil(t, err)
+
+	result := post(t, sink)
+	assert.Equal(t, http.StatusBadRequest, result.StatusCode)
+	body, err := ioutil.ReadAll(result.Body)
+	require.Nil(t, err)
+	assert.Equal(t, "400\nname: must be at most 3 characters\nphone: is required\n", string(body))
+	assert.Nil(t, mockDepositor.msg)
+}
+
+func TestMultiple(t *testing.T) {
+	html, err := os.Open("../resources/survey.html")
+	require.Nil(t, err)
+	defer html.Close()
+
+	mockDepositor := &mockDepositor{}
+	sink, err := newSinkFromReader(mockDepositor, Config{Redirect: location}, html)
+	require.Nil(t, err)
+
+	result := replay(t, sink, "../resources/post-survey")
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+
+	msg := mockDepositor.msg
+	require.NotNil(t, msg)
+	assert.Equal(t, "name: crasm\ninterests: go\ninterests: html\nlanguages: en\nlanguages: fr\n", msg.Body)
+
+	require.Len(t, msg.Attachments, 2)
+	assert.Equal(t, "tiny.ppm", msg.Attachments[0].Name)
+	assert.Equal(t, "image/x-portable-pixmap", msg.Attachments[0].ContentType)
+	assert.Equal(t, "notes.txt", msg.Attachments[1].Name)
+	notes, err := ioutil.ReadAll(msg.Attachments[1].Data)
+	require.Nil(t, err)
+	assert.Equal(t, "formsink notes\n", string(notes))
+}
+
+// Fields that aren't declared as multi-valued only keep their first value.
+func TestMultipleUndeclared(t *testing.T) {
+	mockDepositor := &mockDepositor{}
+	form := &Form{
+		Name:   "survey",
+		Fields: []string{"name", "interests"},
+		Files:  []string{"photos"},
+	}
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, form)
+	require.Nil(t, err)
+
+	result := replay(t, sink, "../resources/post-survey")
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+
+	msg := mockDepositor.msg
+	require.NotNil(t, msg)
+	assert.Equal(t, "name: crasm\ninterests: go\n", msg.Body)
+	require.Len(t, msg.Attachments, 1)
+	assert.Equal(t, "tiny.ppm", msg.Attachments[0].Name)
+}
+
+func TestFormSettings(t *testing.T) {
+	mockDepositor := &mockDepositor{}
+
+	form := *simpleForm
+	form.Redirect = "https://vczf.io/thanks"
+	form.Subject = "Hello from the website"
+	form.To = []mail.Address{mail.Address{Address: "crasm@vczf.io"}}
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, &form)
+	require.Nil(t, err)
+
+	result := post(t, sink)
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+	assert.Equal(t, "https://vczf.io/thanks", result.Header.Get("Location"))
+
+	require.NotNil(t, mockDepositor.msg)
+	assert.Equal(t, "Hello from the website", mockDepositor.msg.Subject)
+	assert.Equal(t, form.To, mockDepositor.msg.To)
+}
+
+func TestFormErrorRedirect(t *testing.T) {
+	mockDepositor := &mockDepositor{}
+
+	form := *simpleForm
+	form.ErrorRedirect = "https://vczf.io/oops"
+	form.Constraints = map[string]*Constraint{
+		"phone": &Constraint{Required: true},
+	}
+	form.Fields = append(form.Fields, "phone")
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, &form)
+	require.Nil(t, err)
+
+	result := post(t, sink)
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+	assert.Equal(t, "https://vczf.io/oops", result.Header.Get("Location"))
+	assert.Nil(t, mockDepositor.msg)
+}
+
+func TestFormMaxSize(t *testing.T) {
+	mockDepositor := &mockDepositor{}
+
+	form := *simpleForm
+	form.MaxSize = 100 // resources/post is larger than this
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, &form)
+	require.Nil(t, err)
+
+	result := post(t, sink)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, result.StatusCode)
+	assert.Nil(t, mockDepositor.msg)
+}
+
+func TestLabelsAndSections(t *testing.T) {
+	mockDepositor := &mockDepositor{}
+
+	form := &Form{
+		Name:   "order",
+		Fields: []string{"msg_body_2", "street", "city", "gift", "note"},
+		Labels: map[string]string{
+			"msg_body_2": "Your message",
+			"street":     "Street",
+			"city":       "City",
+		},
+		Legends: map[string]string{
+			"street": "Shipping address",
+			"city":   "Shipping address",
+			"gift":   "Extras",
+		},
+	}
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, form)
+	require.Nil(t, err)
+
+	result := submit(t, sink, "/order", "application/x-www-form-urlencoded",
+		"msg_body_2=hi&street=1+Main+St&city=Springfield&gift=yes&note=thanks")
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+
+	require.NotNil(t, mockDepositor.msg)
+	assert.Equal(t, `Your message: hi
+
+Shipping address
+----------------
+Street: 1 Main St
+City: Springfield
+
+Extras
+------
+gift: yes
+
+note: thanks
+`, mockDepositor.msg.Body)
+}
+
+func TestReplyTo(t *testing.T) {
+	form := &Form{
+		Name:        "contact",
+		Fields:      []string{"name", "email"},
+		ReplyTo:     "email",
+		ReplyToName: "name",
+	}
+
+	cases := []struct {
+		name, email string
+		replyTo     mail.Address
+	}{
+		{"crasm", "crasm@vczf.io", mail.Address{Name: "crasm", Address: "crasm@vczf.io"}},
+		{"", "crasm@vczf.io", mail.Address{Address: "crasm@vczf.io"}},
+		{"Mallory\r\nBcc: victim@example.com", "crasm@vczf.io",
+			mail.Address{Name: "Mallory Bcc: victim@example.com", Address: "crasm@vczf.io"}},
+		{"crasm", "", mail.Address{}},
+		{"crasm", "not an address", mail.Address{}},
+		{"crasm", "crasm@vczf.io\r\nBcc: victim@example.com", mail.Address{}},
+		{"crasm", "crasm@vczf.io, victim@example.com", mail.Address{}},
+		{"crasm", "Mallory <crasm@vczf.io>", mail.Address{}},
+	}
+
+	for _, c := range cases {
+		msg := buildMessage(&Config{}, form, &multipart.Form{
+			Value: map[string][]string{
+				"name":  []string{c.name},
+				"email": []string{c.email},
+			},
+		})
+		assert.Equal(t, c.replyTo, msg.ReplyTo, "%q %q", c.name, c.email)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	config := Config{
+		Redirect: location,
+		From:     mail.Address{Name: "Website", Address: "www@vczf.io"},
+		Domain:   "vczf.io",
+		Cc: map[string][]mail.Address{
+			"contact": []mail.Address{mail.Address{Address: "archive@vczf.io"}},
+		},
+		Bcc: map[string][]mail.Address{
+			"contact": []mail.Address{mail.Address{Address: "audit@vczf.io"}},
+		},
+	}
+
+	first := &mockDepositor{}
+	sink, err := newSink(first, config, simpleForm)
+	require.Nil(t, err)
+
+	post(t, sink)
+	msg := first.msg
+	require.NotNil(t, msg)
+	assert.Equal(t, config.From, msg.From)
+	assert.Equal(t, []mail.Address{mail.Address{Address: "contact@vczf.io"}}, msg.To)
+	assert.Equal(t, config.Cc["contact"], msg.Cc)
+	assert.Equal(t, config.Bcc["contact"], msg.Bcc)
+
+	// A second sink in the same process is unaffected.
+	other := &mockDepositor{}
+	config.To = map[string][]mail.Address{
+		"contact": []mail.Address{mail.Address{Address: "crasm@vczf.io"}},
+	}
+	config.From = mail.Address{}
+	config.Domain = "example.com"
+	form := *simpleForm
+	form.Cc = []mail.Address{mail.Address{Address: "sales@vczf.io"}}
+	sink, err = newSink(other, config, &form)
+	require.Nil(t, err)
+
+	post(t, sink)
+	msg = other.msg
+	require.NotNil(t, msg)
+	assert.Equal(t, mail.Address{Name: "FormSink", Address: "FormSink@example.com"}, msg.From)
+	assert.Equal(t, config.To["contact"], msg.To)
+	assert.Equal(t, form.Cc, msg.Cc)
+	assert.Equal(t, mail.Address{Name: "Website", Address: "www@vczf.io"}, first.msg.From)
+}
@@ -0,0 +1,400 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpoehls/gophermail"
+)
+
+const defaultIMAPTimeout = 30 * time.Second
+
+// IMAPConfig describes a mailbox on an IMAP server that messages are
+// appended to instead of being stored in a maildir.
+type IMAPConfig struct {
+	// Addr is the server's host and port, e.g. "imap.example.com:993".
+	Addr string
+
+	// TLS is "starttls" (the default), "tls" for implicit TLS as on port
+	// 993, or "none".
+	TLS string
+
+	// TLSConfig is used for both STARTTLS and implicit TLS. Defaults to
+	// verifying the server's certificate against its host name.
+	TLSConfig *tls.Config
+
+	Username string
+	Password string
+
+	// Mailbox is where messages are appended. Defaults to "INBOX".
+	// Mailboxes maps form names to mailboxes of their own, which are
+	// created if needed.
+	Mailbox   string
+	Mailboxes map[string]string
+
+	// Flags are set on each appended message, e.g. `\Flagged`.
+	Flags []string
+
+	// Timeout limits each delivery, including connecting. Defaults to 30
+	// seconds.
+	Timeout time.Duration
+}
+
+// imapDepositor appends messages to a mailbox with IMAP APPEND (RFC 3501).
+// It keeps its connection open between messages and reconnects if the
+// server has closed it in the meantime.
+type imapDepositor struct {
+	config IMAPConfig
+	host   string
+
+	mu   sync.Mutex // Serializes use of conn
+	conn *imapConn  // nil until connected
+}
+
+func newIMAPDepositor(config IMAPConfig) (*imapDepositor, error) {
+	host, _, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return nil, e("invalid IMAP address %q: %v", config.Addr, err)
+	}
+
+	switch config.TLS {
+	case "":
+		config.TLS = "starttls"
+	case "starttls", "tls", "none":
+	default:
+		return nil, e("unknown IMAP TLS mode %q", config.TLS)
+	}
+
+	if config.Username == "" {
+		return nil, e("missing IMAP username")
+	}
+	if config.Mailbox == "" {
+		config.Mailbox = "INBOX"
+	}
+	quoted := []string{config.Username, config.Password, config.Mailbox}
+	for _, mailbox := range config.Mailboxes {
+		quoted = append(quoted, mailbox)
+	}
+	for _, s := range quoted {
+		if strings.ContainsAny(s, "\r\n") {
+			return nil, e("IMAP credentials and mailboxes can't contain line breaks")
+		}
+	}
+	for _, flag := range config.Flags {
+		if !isIMAPAtom(strings.TrimPrefix(flag, `\`)) {
+			return nil, e("invalid IMAP flag %q", flag)
+		}
+	}
+
+	if config.TLSConfig == nil {
+		config.TLSConfig = &tls.Config{ServerName: host}
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultIMAPTimeout
+	}
+
+	return &imapDepositor{config: config, host: host}, nil
+}
+
+func (i *imapDepositor) Deposit(ctx context.Context, s *Submission) error {
+	raw, err := s.Message.Bytes()
+	if err != nil {
+		return err
+	}
+
+	return i.DepositRaw(ctx, s.Message, raw)
+}
+
+func (i *imapDepositor) DepositRaw(ctx context.Context, msg *gophermail.Message, raw []byte) error {
+	mailbox := i.config.Mailbox
+	if m, ok := i.config.Mailboxes[msg.Headers.Get(formHeader)]; ok {
+		mailbox = m
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	deadline := time.Now().Add(i.config.Timeout)
+	reused := i.conn != nil
+	if !reused {
+		conn, err := i.dial(ctx, deadline)
+		if err != nil {
+			return err
+		}
+		i.conn = conn
+	}
+
+	err := i.conn.append(deadline, mailbox, i.config.Flags, raw)
+	if _, refused := err.(*IMAPError); err != nil && !refused {
+		// The connection is broken, e.g. because the server closed it
+		// while it was idle, so try again once with a new one.
+		i.conn.close()
+		i.conn = nil
+		if !reused {
+			return err
+		}
+
+		conn, dialErr := i.dial(ctx, deadline)
+		if dialErr != nil {
+			return dialErr
+		}
+		i.conn = conn
+		err = i.conn.append(deadline, mailbox, i.config.Flags, raw)
+		if _, refused := err.(*IMAPError); err != nil && !refused {
+			i.conn.close()
+			i.conn = nil
+		}
+	}
+	return err
+}
+
+// Close logs out of the server, if connected.
+func (i *imapDepositor) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.conn == nil {
+		return nil
+	}
+	i.conn.setDeadline(time.Now().Add(i.config.Timeout))
+	i.conn.command(nil, "LOGOUT")
+	err := i.conn.close()
+	i.conn = nil
+	return err
+}
+
+// dial connects and logs in.
+func (i *imapDepositor) dial(ctx context.Context, deadline time.Time) (*imapConn, error) {
+	dialer := &net.Dialer{Deadline: deadline}
+
+	var netConn net.Conn
+	var err error
+	if i.config.TLS == "tls" {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: i.config.TLSConfig}
+		netConn, err = tlsDialer.DialContext(ctx, "tcp", i.config.Addr)
+	} else {
+		netConn, err = dialer.DialContext(ctx, "tcp", i.config.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := newIMAPConn(netConn)
+	c.setDeadline(deadline)
+	if err := i.login(c); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (i *imapDepositor) login(c *imapConn) error {
+	greeting, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		return e("unexpected IMAP greeting %q", greeting)
+	}
+
+	secure := i.config.TLS == "tls"
+	if i.config.TLS == "starttls" {
+		if err := c.command(nil, "STARTTLS"); err != nil {
+			return err
+		}
+		tlsConn := tls.Client(c.conn, i.config.TLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		c.reset(tlsConn)
+		secure = true
+	}
+
+	// Like smtp.PlainAuth, refuse to send credentials in the clear to
+	// anything but localhost.
+	if !secure && !isLocalhost(i.host) {
+		return e("refusing IMAP LOGIN without TLS")
+	}
+	return c.command(nil, "LOGIN %s %s", imapQuote(i.config.Username), imapQuote(i.config.Password))
+}
+
+// imapConn is a connection to an IMAP server, used one command at a time.
+type imapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+func newIMAPConn(conn net.Conn) *imapConn {
+	return &imapConn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *imapConn) reset(conn net.Conn) {
+	c.conn = conn
+	c.r = bufio.NewReader(conn)
+}
+
+func (c *imapConn) setDeadline(deadline time.Time) {
+	c.conn.SetDeadline(deadline)
+}
+
+func (c *imapConn) close() error {
+	return c.conn.Close()
+}
+
+// append appends raw to mailbox, creating the mailbox if the server says
+// it doesn't exist.
+func (c *imapConn) append(deadline time.Time, mailbox string, flags []string, raw []byte) error {
+	c.setDeadline(deadline)
+
+	err := c.command(raw, "APPEND %s (%s) {%d}", imapQuote(mailbox), strings.Join(flags, " "), len(raw))
+	if ierr, ok := err.(*IMAPError); ok && ierr.Code == "TRYCREATE" {
+		if err := c.command(nil, "CREATE %s", imapQuote(mailbox)); err != nil {
+			return err
+		}
+		err = c.command(raw, "APPEND %s (%s) {%d}", imapQuote(mailbox), strings.Join(flags, " "), len(raw))
+	}
+	return err
+}
+
+// command sends a tagged command and reads responses up to its completion,
+// sending literal when the server asks for it. Responses other than OK are
+// returned as *IMAPError.
+func (c *imapConn) command(literal []byte, format string, args ...interface{}) error {
+	c.tag++
+	tag := "a" + strconv.Itoa(c.tag)
+	if _, err := fmt.Fprintf(c.conn, tag+" "+format+"\r\n", args...); err != nil {
+		return err
+	}
+
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case strings.HasPrefix(line, "+"):
+			if literal == nil {
+				return e("unexpected IMAP continuation %q", line)
+			}
+			if _, err := c.conn.Write(literal); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(c.conn, "\r\n"); err != nil {
+				return err
+			}
+			literal = nil
+
+		case strings.HasPrefix(line, tag+" "):
+			return parseIMAPStatus(strings.TrimPrefix(line, tag+" "))
+		}
+		// Other untagged responses don't matter here.
+	}
+}
+
+// readLine reads a response line without its CRLF. Literals within it,
+// e.g. in untagged FETCH responses, are read and dropped.
+func (c *imapConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	for strings.HasSuffix(line, "}") {
+		open := strings.LastIndex(line, "{")
+		if open < 0 {
+			break
+		}
+		n, err := strconv.Atoi(line[open+1 : len(line)-1])
+		if err != nil {
+			break
+		}
+		if _, err := io.CopyN(ioutil.Discard, c.r, int64(n)); err != nil {
+			return "", err
+		}
+		rest, err := c.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = line[:open] + strings.TrimRight(rest, "\r\n")
+	}
+	return line, nil
+}
+
+// IMAPError is a NO or BAD response from an IMAP server.
+type IMAPError struct {
+	Status string // "NO" or "BAD"
+	Code   string // The response code, e.g. "TRYCREATE", if any
+	Text   string
+}
+
+func (ie *IMAPError) Error() string {
+	if ie.Code != "" {
+		return e("IMAP %s [%s] %s", ie.Status, ie.Code, ie.Text).Error()
+	}
+	return e("IMAP %s %s", ie.Status, ie.Text).Error()
+}
+
+// Temporary reports whether the server may accept the message later, as
+// indicated by the response codes of RFC 5530.
+func (ie *IMAPError) Temporary() bool {
+	switch ie.Code {
+	case "UNAVAILABLE", "INUSE", "LIMIT", "OVERQUOTA", "SERVERBUG":
+		return true
+	}
+	return false
+}
+
+// parseIMAPStatus parses the rest of a tagged response, e.g.
+// "NO [TRYCREATE] No such mailbox".
+func parseIMAPStatus(resp string) error {
+	status := resp
+	text := ""
+	if i := strings.Index(resp, " "); i >= 0 {
+		status, text = resp[:i], resp[i+1:]
+	}
+	if status == "OK" {
+		return nil
+	}
+
+	ierr := &IMAPError{Status: status, Text: text}
+	if strings.HasPrefix(text, "[") {
+		if end := strings.Index(text, "]"); end > 0 {
+			// The code may be empty, as in "NO [] oops".
+			if fields := strings.Fields(text[1:end]); len(fields) > 0 {
+				ierr.Code = fields[0]
+			}
+			ierr.Text = strings.TrimSpace(text[end+1:])
+		}
+	}
+	return ierr
+}
+
+// imapQuote makes s, which must not contain line breaks, an IMAP quoted
+// string.
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// isIMAPAtom reports whether s can be sent as an atom, e.g. a flag.
+func isIMAPAtom(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`(){%*"\]`, r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,283 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIMAP is an in-process stand-in for an IMAP server that supports just
+// enough to log in and append messages.
+type fakeIMAP struct {
+	fakeServer
+
+	mu          sync.Mutex
+	mailboxes   map[string]bool // Existing mailboxes
+	appended    []imapAppend
+	connections int
+	tls         bool
+	username    string
+	password    string
+	dropAfter   bool   // Whether to hang up after each APPEND
+	appendReply string // Reply to APPEND instead of OK, e.g. "NO [OVERQUOTA] Full"
+}
+
+type imapAppend struct {
+	mailbox string
+	flags   string
+	data    string
+}
+
+func newFakeIMAP(t *testing.T, tlsConfig *tls.Config, implicit bool) *fakeIMAP {
+	s := &fakeIMAP{
+		fakeServer: listenFake(t, "tcp", "127.0.0.1:0", tlsConfig, implicit),
+		mailboxes:  map[string]bool{"INBOX": true},
+	}
+	s.accept(s.serve)
+	return s
+}
+
+func (s *fakeIMAP) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	s.mu.Lock()
+	s.connections++
+	s.tls = s.implicit
+	s.mu.Unlock()
+
+	reply("* OK fake IMAP ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+		tag, verb, args := fields[0], strings.ToUpper(fields[1]), ""
+		if len(fields) > 2 {
+			args = fields[2]
+		}
+
+		s.mu.Lock()
+		switch verb {
+		case "STARTTLS":
+			reply("%s OK Begin TLS negotiation now", tag)
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				s.mu.Unlock()
+				return
+			}
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+			s.tls = true
+
+		case "LOGIN":
+			credentials := strings.SplitN(args, `" "`, 2)
+			s.username = strings.Trim(credentials[0], `"`)
+			s.password = strings.Trim(credentials[1], `"`)
+			reply("%s OK LOGIN completed", tag)
+
+		case "CREATE":
+			s.mailboxes[strings.Trim(args, `"`)] = true
+			reply("%s OK CREATE completed", tag)
+
+		case "APPEND":
+			// "mailbox" (flags) {size}
+			mailbox := strings.Trim(args[:strings.Index(args, " (")], `"`)
+			flags := args[strings.Index(args, "(")+1 : strings.Index(args, ")")]
+			size, _ := strconv.Atoi(args[strings.LastIndex(args, "{")+1 : len(args)-1])
+
+			if !s.mailboxes[mailbox] {
+				reply("%s NO [TRYCREATE] Mailbox doesn't exist", tag)
+				break
+			}
+			reply("+ Ready for literal data")
+			data := make([]byte, size)
+			io.ReadFull(r, data)
+			r.ReadString('\n')
+
+			if s.appendReply != "" {
+				reply("%s %s", tag, s.appendReply)
+				break
+			}
+			s.appended = append(s.appended, imapAppend{mailbox, flags, string(data)})
+			reply("* 3 EXISTS")
+			reply("%s OK [APPENDUID 1 %d] APPEND completed", tag, len(s.appended))
+			if s.dropAfter {
+				s.mu.Unlock()
+				return
+			}
+
+		case "LOGOUT":
+			reply("* BYE")
+			reply("%s OK LOGOUT completed", tag)
+			s.mu.Unlock()
+			return
+
+		default:
+			reply("%s BAD Unknown command", tag)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestIMAP(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfig(t)
+
+	for _, mode := range []string{"starttls", "tls"} {
+		server := newFakeIMAP(t, serverTLS, mode == "tls")
+		defer server.Close()
+
+		imap, err := newIMAPDepositor(IMAPConfig{
+			Addr:      server.Addr(),
+			TLS:       mode,
+			TLSConfig: clientTLS,
+			Username:  "crasm",
+			Password:  `hunter"2`,
+			Mailboxes: map[string]string{"survey": "Forms/Survey"},
+			Flags:     []string{`\Flagged`, "$Form"},
+			Timeout:   5 * time.Second,
+		})
+		require.Nil(t, err)
+
+		require.Nil(t, depositMessage(imap, formMessage("contact")), mode)
+		require.Nil(t, depositMessage(imap, formMessage("survey")), mode)
+		require.Nil(t, imap.Close())
+
+		server.mu.Lock()
+		assert.True(t, server.tls)
+		assert.Equal(t, 1, server.connections, "reuses its connection")
+		assert.Equal(t, "crasm", server.username)
+		assert.Equal(t, `hunter\"2`, server.password)
+		require.Len(t, server.appended, 2)
+		assert.Equal(t, "INBOX", server.appended[0].mailbox)
+		assert.Equal(t, "Forms/Survey", server.appended[1].mailbox, "creates mailboxes")
+		assert.Equal(t, `\Flagged $Form`, server.appended[0].flags)
+		assert.Contains(t, server.appended[0].data, "Subject: contact request\r\n")
+		server.mu.Unlock()
+	}
+}
+
+// A connection closed by the server, e.g. for being idle, is replaced.
+func TestIMAPReconnect(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfig(t)
+	server := newFakeIMAP(t, serverTLS, true)
+	defer server.Close()
+	server.mu.Lock()
+	server.dropAfter = true
+	server.mu.Unlock()
+
+	imap, err := newIMAPDepositor(IMAPConfig{
+		Addr:      server.Addr(),
+		TLS:       "tls",
+		TLSConfig: clientTLS,
+		Username:  "crasm",
+	})
+	require.Nil(t, err)
+	defer imap.Close()
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, depositMessage(imap, formMessage("contact")))
+	}
+
+	server.mu.Lock()
+	assert.Len(t, server.appended, 3)
+	assert.Equal(t, 3, server.connections)
+	server.mu.Unlock()
+}
+
+func TestIMAPErrors(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfig(t)
+
+	cases := []struct {
+		reply  string
+		status int
+	}{
+		{"NO [OVERQUOTA] Mailbox is full", http.StatusServiceUnavailable},
+		{"NO Message too big", http.StatusInternalServerError},
+		{"BAD Invalid arguments", http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		server := newFakeIMAP(t, serverTLS, true)
+		defer server.Close()
+		server.mu.Lock()
+		server.appendReply = c.reply
+		server.mu.Unlock()
+
+		imap, err := newIMAPDepositor(IMAPConfig{
+			Addr:      server.Addr(),
+			TLS:       "tls",
+			TLSConfig: clientTLS,
+			Username:  "crasm",
+		})
+		require.Nil(t, err)
+		sink, err := newSink(imap, Config{Redirect: location}, simpleForm)
+		require.Nil(t, err)
+
+		result := post(t, sink)
+		assert.Equal(t, c.status, result.StatusCode, c.reply)
+
+		// Refusals don't break the connection.
+		server.mu.Lock()
+		server.appendReply = ""
+		server.mu.Unlock()
+		require.Nil(t, depositMessage(imap, formMessage("contact")))
+		server.mu.Lock()
+		assert.Equal(t, 1, server.connections)
+		server.mu.Unlock()
+		imap.Close()
+	}
+
+	// Nothing listening
+	imap, err := newIMAPDepositor(IMAPConfig{Addr: "127.0.0.1:1", TLS: "none", Username: "crasm", Timeout: time.Second})
+	require.Nil(t, err)
+	assert.NotNil(t, depositMessage(imap, formMessage("contact")))
+
+	// Untrusted certificate
+	server := newFakeIMAP(t, serverTLS, false)
+	defer server.Close()
+	imap, err = newIMAPDepositor(IMAPConfig{Addr: server.Addr(), Username: "crasm"})
+	require.Nil(t, err)
+	assert.NotNil(t, depositMessage(imap, formMessage("contact")))
+
+	// Bad configuration
+	for _, config := range []IMAPConfig{
+		IMAPConfig{Addr: "localhost", Username: "crasm"},
+		IMAPConfig{Addr: "localhost:143"},
+		IMAPConfig{Addr: "localhost:143", Username: "crasm", TLS: "ssl"},
+		IMAPConfig{Addr: "localhost:143", Username: "crasm", Flags: []string{"(Flagged"}},
+		IMAPConfig{Addr: "localhost:143", Username: "crasm", Mailbox: "INBOX\r\nA1 LOGOUT"},
+	} {
+		_, err := newIMAPDepositor(config)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestParseIMAPStatus(t *testing.T) {
+	assert.Nil(t, parseIMAPStatus("OK APPEND completed"))
+	assert.Nil(t, parseIMAPStatus("OK"))
+	assert.Equal(t, &IMAPError{"NO", "TRYCREATE", "No such mailbox"},
+		parseIMAPStatus("NO [TRYCREATE] No such mailbox"))
+	assert.Equal(t, &IMAPError{"NO", "BADCHARSET", ""},
+		parseIMAPStatus("NO [BADCHARSET (UTF-8)]"))
+	assert.Equal(t, &IMAPError{"BAD", "", "Syntax error"},
+		parseIMAPStatus("BAD Syntax error"))
+	assert.Equal(t, &IMAPError{"NO", "", "oops"},
+		parseIMAPStatus("NO [] oops"))
+	assert.Equal(t, &IMAPError{"NO", "", ""},
+		parseIMAPStatus("NO [ ]"))
+}
@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"mime/multipart"
+)
+
+// The default limit on the size of a request body, which is also how much
+// of a multipart body is kept in memory rather than in temporary files.
+const defaultMaxBodySize = defaultMaxMemory
+
+// Limits bound the size of submissions. Submissions exceeding them are
+// rejected with 413 Request Entity Too Large. Zero values don't limit
+// anything.
+type Limits struct {
+	// MaxBodySize limits the whole request body, in bytes, and is
+	// enforced while it's read, so that nothing larger ever ends up in
+	// memory or temporary files. Defaults to 32 MB; negative values don't
+	// limit it.
+	MaxBodySize int64
+
+	// The rest are enforced as multipart bodies are read too, and checked
+	// once other bodies are.
+
+	MaxFileSize  int64 // Of each uploaded file, in bytes
+	MaxFiles     int   // Uploaded files, across all file fields
+	MaxFieldSize int64 // Of each value of each field, in bytes
+}
+
+// limitError is returned for submissions exceeding Limits.
+type limitError struct {
+	error
+}
+
+// forForm returns the limits that apply to submissions of form, which are
+// its own where it sets them.
+func (l Limits) forForm(form *Form) Limits {
+	if form.MaxSize > 0 {
+		l.MaxBodySize = form.MaxSize
+	}
+	if form.MaxFileSize > 0 {
+		l.MaxFileSize = form.MaxFileSize
+	}
+	if form.MaxFiles > 0 {
+		l.MaxFiles = form.MaxFiles
+	}
+	if form.MaxFieldSize > 0 {
+		l.MaxFieldSize = form.MaxFieldSize
+	}
+	return l
+}
+
+// check returns an error if a parsed submission exceeds any of the limits
+// but MaxBodySize. Multipart submissions have been held to them already.
+func (l Limits) check(submission *multipart.Form) error {
+	if l.MaxFieldSize > 0 {
+		for name, values := range submission.Value {
+			for _, value := range values {
+				if int64(len(value)) > l.MaxFieldSize {
+					return e("field %q is longer than %d bytes", name, l.MaxFieldSize)
+				}
+			}
+		}
+	}
+
+	files := 0
+	for name, metas := range submission.File {
+		files += len(metas)
+		if l.MaxFileSize <= 0 {
+			continue
+		}
+		for _, meta := range metas {
+			if meta.Size > l.MaxFileSize {
+				return e("file %q in %q is larger than %d bytes", meta.Filename, name, l.MaxFileSize)
+			}
+		}
+	}
+	if l.MaxFiles > 0 && files > l.MaxFiles {
+		return e("%d files uploaded, more than %d", files, l.MaxFiles)
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var uploadForm = &Form{
+	Name:     "upload",
+	Fields:   []string{"comment"},
+	Files:    []string{"photos"},
+	Multiple: map[string]bool{"photos": true},
+}
+
+// multipartBody encodes a comment and files of the given sizes.
+func multipartBody(t *testing.T, comment string, sizes ...int) (string, *bytes.Buffer) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	require.Nil(t, mw.WriteField("comment", comment))
+	for _, size := range sizes {
+		part, err := mw.CreateFormFile("photos", "photo.jpg")
+		require.Nil(t, err)
+		_, err = part.Write(bytes.Repeat([]byte{0xff}, size))
+		require.Nil(t, err)
+	}
+	require.Nil(t, mw.Close())
+	return mw.FormDataContentType(), body
+}
+
+func TestLimits(t *testing.T) {
+	cases := []struct {
+		limits  Limits
+		comment string
+		sizes   []int
+		status  int
+	}{
+		{Limits{}, "hi", []int{1 << 20, 1 << 20}, http.StatusNoContent},
+		{Limits{MaxBodySize: 1 << 20}, "hi", []int{1 << 20}, http.StatusRequestEntityTooLarge},
+		{Limits{MaxFileSize: 1000}, "hi", []int{1000, 1000}, http.StatusNoContent},
+		{Limits{MaxFileSize: 1000}, "hi", []int{1000, 1001}, http.StatusRequestEntityTooLarge},
+		{Limits{MaxFiles: 2}, "hi", []int{10, 10}, http.StatusNoContent},
+		{Limits{MaxFiles: 2}, "hi", []int{10, 10, 10}, http.StatusRequestEntityTooLarge},
+		{Limits{MaxFieldSize: 10}, strings.Repeat("x", 10), nil, http.StatusNoContent},
+		{Limits{MaxFieldSize: 10}, strings.Repeat("x", 11), nil, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, c := range cases {
+		mock := &mockDepositor{}
+		sink, err := newSink(mock, Config{Limits: c.limits}, uploadForm)
+		require.Nil(t, err)
+
+		contentType, body := multipartBody(t, c.comment, c.sizes...)
+		result := submit(t, sink, "/upload", contentType, body.String())
+		assert.Equal(t, c.status, result.StatusCode, "%+v %v", c.limits, c.sizes)
+		assert.Equal(t, c.status == http.StatusNoContent, mock.msg != nil)
+	}
+}
+
+// A form's own limits take precedence over the sink's.
+func TestFormLimits(t *testing.T) {
+	form := *uploadForm
+	form.MaxFileSize = 5000
+	form.MaxFieldSize = 5
+	sink, err := newSink(&mockDepositor{}, Config{Limits: Limits{MaxFileSize: 1000, MaxFieldSize: 100}}, &form)
+	require.Nil(t, err)
+
+	contentType, body := multipartBody(t, "hi", 2000)
+	assert.Equal(t, http.StatusNoContent, submit(t, sink, "/upload", contentType, body.String()).StatusCode)
+
+	contentType, body = multipartBody(t, "hello!", 10)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, submit(t, sink, "/upload", contentType, body.String()).StatusCode)
+
+	result := submit(t, sink, "/upload", "application/json", `{"comment": ["hi", "hello!"]}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, result.StatusCode)
+}
+
+// countingReader is an endless stream of bytes that counts how many were
+// read.
+type countingReader struct {
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// Huge bodies are cut off rather than read in full.
+func TestBodyLimit(t *testing.T) {
+	sink, err := newSink(&mockDepositor{}, Config{Limits: Limits{MaxBodySize: 1 << 20}}, uploadForm)
+	require.Nil(t, err)
+
+	// The start of a body, which then goes on forever, by Content-Type.
+	starts := map[string]string{
+		"multipart/form-data; boundary=xxx": "--xxx\r\n" +
+			"Content-Disposition: form-data; name=\"photos\"; filename=\"huge.jpg\"\r\n\r\n",
+		"application/x-www-form-urlencoded": "comment=",
+		"application/json":                  `{"comment": "`,
+	}
+	for contentType, start := range starts {
+		endless := &countingReader{}
+		body := io.MultiReader(strings.NewReader(start), endless)
+		r := httptest.NewRequest(http.MethodPost, "/upload", body)
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		sink.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, contentType)
+		assert.True(t, endless.n < 2<<20, "read %d bytes of %s", endless.n, contentType)
+	}
+}
+
+// Files and fields are cut off as soon as they exceed their limits, even
+// when the body isn't limited.
+func TestStreamingLimits(t *testing.T) {
+	cases := map[string]Limits{
+		"--xxx\r\nContent-Disposition: form-data; name=\"photos\"; filename=\"huge.jpg\"\r\n\r\n": {MaxBodySize: -1, MaxFileSize: 1 << 20},
+		"--xxx\r\nContent-Disposition: form-data; name=\"comment\"\r\n\r\n":                       {MaxBodySize: -1, MaxFieldSize: 1 << 20},
+	}
+	for start, limits := range cases {
+		sink, err := newSink(&mockDepositor{}, Config{Limits: limits}, uploadForm)
+		require.Nil(t, err)
+
+		endless := &countingReader{}
+		r := httptest.NewRequest(http.MethodPost, "/upload", io.MultiReader(strings.NewReader(start), endless))
+		r.Header.Set("Content-Type", "multipart/form-data; boundary=xxx")
+		w := httptest.NewRecorder()
+		sink.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, "%+v", limits)
+		assert.True(t, endless.n < 2<<20, "read %d bytes with %+v", endless.n, limits)
+	}
+
+	// The files after the last one allowed aren't read at all.
+	mock := &mockDepositor{}
+	sink, err := newSink(mock, Config{Limits: Limits{MaxBodySize: -1, MaxFiles: 2}}, uploadForm)
+	require.Nil(t, err)
+	contentType, body := multipartBody(t, "hi", 10, 10, 1<<20)
+	r := httptest.NewRequest(http.MethodPost, "/upload", body)
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	sink.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.True(t, body.Len() > 1<<19, "%d bytes left unread", body.Len())
+	assert.Nil(t, mock.msg)
+}
+
+// Uploads too large to keep in memory leave no temporary files or open
+// files behind.
+func TestLimitsTempFiles(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmp)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	mock := &mockDepositor{}
+	sink, err := newSink(mock, Config{Limits: Limits{MaxBodySize: -1}}, uploadForm)
+	require.Nil(t, err)
+	contentType, body := multipartBody(t, "hi", defaultMaxMemory+1<<20)
+	result := submit(t, sink, "/upload", contentType, body.String())
+	assert.Equal(t, http.StatusNoContent, result.StatusCode)
+
+	left, err := ioutil.ReadDir(tmp)
+	require.Nil(t, err)
+	assert.Empty(t, left)
+
+	require.NotNil(t, mock.msg)
+	require.Len(t, mock.msg.Attachments, 1)
+	_, err = mock.msg.Attachments[0].Data.Read(make([]byte, 1))
+	assert.Equal(t, os.ErrClosed, errors.Unwrap(err))
+}
@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jpoehls/gophermail"
+)
+
+const defaultLMTPTimeout = 30 * time.Second
+
+// LMTPConfig describes an LMTP server, such as Dovecot's, that messages
+// are delivered to instead of being written into the maildir directly.
+type LMTPConfig struct {
+	// Network is "tcp" (the default) or "unix".
+	Network string
+
+	// Addr is a host and port, or the path of a unix socket, e.g.
+	// "/var/run/dovecot/lmtp".
+	Addr string
+
+	// Timeout limits the whole exchange with the server, including
+	// connecting. Defaults to 30 seconds.
+	Timeout time.Duration
+
+	// Hostname is sent with LHLO. Defaults to "localhost".
+	Hostname string
+}
+
+// lmtpDepositor delivers messages over LMTP (RFC 2033). Unlike SMTP, the
+// server replies for each recipient after the message is sent, so some
+// recipients may receive it while others don't. If it failed for some of
+// them temporarily, but not for all, a *PartialDeliveryError names only
+// those, so that the others don't get it twice. Recipients that refused it
+// for good are only logged then, and if no one is left to try again, the
+// message is delivered.
+type lmtpDepositor struct {
+	config LMTPConfig
+}
+
+func newLMTPDepositor(config LMTPConfig) (*lmtpDepositor, error) {
+	switch config.Network {
+	case "":
+		config.Network = "tcp"
+	case "tcp", "unix":
+	default:
+		return nil, e("unknown LMTP network %q", config.Network)
+	}
+
+	if config.Addr == "" {
+		return nil, e("missing LMTP address")
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultLMTPTimeout
+	}
+	if config.Hostname == "" {
+		config.Hostname = "localhost"
+	}
+
+	return &lmtpDepositor{config}, nil
+}
+
+func (l *lmtpDepositor) Deposit(ctx context.Context, s *Submission) error {
+	raw, err := s.Message.Bytes()
+	if err != nil {
+		return err
+	}
+
+	return l.DepositRaw(ctx, s.Message, raw)
+}
+
+func (l *lmtpDepositor) DepositRaw(ctx context.Context, msg *gophermail.Message, raw []byte) error {
+	recipients := envelopeRecipients(ctx, msg)
+	if len(recipients) < 1 {
+		return gophermail.ErrMissingRecipient
+	}
+
+	deadline := time.Now().Add(l.config.Timeout)
+	conn, err := (&net.Dialer{Deadline: deadline}).DialContext(ctx, l.config.Network, l.config.Addr)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline)
+
+	text := textproto.NewConn(conn)
+	defer text.Close()
+
+	if _, _, err := text.ReadResponse(220); err != nil {
+		return deliveryError("", err)
+	}
+	if err := command(text, 250, "LHLO %s", l.config.Hostname); err != nil {
+		return err
+	}
+	if err := command(text, 250, "MAIL FROM:<%s>", msg.From.Address); err != nil {
+		return err
+	}
+
+	failures := DeliveryErrors{}
+	accepted := []string{}
+	delivered := 0
+	for _, rcpt := range recipients {
+		if err := command(text, 25, "RCPT TO:<%s>", rcpt); err != nil {
+			derr, ok := err.(*DeliveryError)
+			if !ok {
+				return err
+			}
+			derr.Recipient = rcpt
+			failures = append(failures, derr)
+		} else {
+			accepted = append(accepted, rcpt)
+		}
+	}
+
+	if len(accepted) > 0 {
+		if err := command(text, 354, "DATA"); err != nil {
+			return err
+		}
+
+		w := text.DotWriter()
+		if _, err := w.Write(raw); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		// One reply for each accepted recipient, in order.
+		for _, rcpt := range accepted {
+			if _, _, err := text.ReadResponse(250); err != nil {
+				derr, ok := deliveryError(rcpt, err).(*DeliveryError)
+				if !ok {
+					return err
+				}
+				failures = append(failures, derr)
+			} else {
+				delivered++
+			}
+		}
+	} else {
+		command(text, 250, "RSET")
+	}
+
+	command(text, 221, "QUIT")
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	temporary := DeliveryErrors{}
+	for _, failure := range failures {
+		if failure.Temporary() {
+			temporary = append(temporary, failure)
+		}
+	}
+	if delivered == 0 && (len(temporary) == 0 || len(temporary) == len(failures)) {
+		return failures
+	}
+
+	for _, failure := range failures {
+		if !failure.Temporary() {
+			logrus.WithFields(logrus.Fields{
+				"recipient": failure.Recipient,
+				"error":     failure.Error(),
+			}).Warn("LMTP server refused a recipient for good")
+		}
+	}
+	if len(temporary) == 0 {
+		return nil
+	}
+	return &PartialDeliveryError{temporary}
+}
+
+// command sends a command and checks that its reply code starts with
+// expectCode, as in textproto.Conn.ReadResponse.
+func command(text *textproto.Conn, expectCode int, format string, args ...interface{}) error {
+	id, err := text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+
+	if _, _, err := text.ReadResponse(expectCode); err != nil {
+		return deliveryError("", err)
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLMTP is an in-process stand-in for an LMTP server such as Dovecot's.
+// Recipients can be refused, either at RCPT or after DATA.
+type fakeLMTP struct {
+	fakeServer
+	rcptReply map[string]string // Replies to RCPT, instead of 250
+	dataReply map[string]string // Replies after DATA, instead of 250
+
+	mu    sync.Mutex
+	lhlo  string
+	from  string
+	rcpts []string
+	data  string
+	rset  bool
+}
+
+func newFakeLMTP(t *testing.T, network, addr string) *fakeLMTP {
+	s := &fakeLMTP{
+		fakeServer: listenFake(t, network, addr, nil, false),
+		rcptReply:  map[string]string{},
+		dataReply:  map[string]string{},
+	}
+	s.accept(s.serve)
+	return s
+}
+
+func (s *fakeLMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+
+	text.PrintfLine("220 localhost fake LMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := strings.TrimSpace(strings.TrimPrefix(line, line[:len(verb)]))
+
+		s.mu.Lock()
+		switch verb {
+		case "LHLO":
+			s.lhlo = arg
+			text.PrintfLine("250-localhost")
+			text.PrintfLine("250 PIPELINING")
+
+		case "MAIL":
+			s.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			text.PrintfLine("250 OK")
+
+		case "RCPT":
+			rcpt := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if reply, ok := s.rcptReply[rcpt]; ok {
+				text.PrintfLine("%s", reply)
+			} else {
+				s.rcpts = append(s.rcpts, rcpt)
+				text.PrintfLine("250 OK")
+			}
+
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			data, _ := ioutil.ReadAll(text.DotReader())
+			s.data = string(data)
+			for _, rcpt := range s.rcpts {
+				if reply, ok := s.dataReply[rcpt]; ok {
+					text.PrintfLine("%s", reply)
+				} else {
+					text.PrintfLine("250 Saved")
+				}
+			}
+
+		case "RSET":
+			s.rset = true
+			text.PrintfLine("250 OK")
+
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			s.mu.Unlock()
+			return
+
+		default:
+			text.PrintfLine("502 Not implemented")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestLMTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, network := range []string{"tcp", "unix"} {
+		addr := "127.0.0.1:0"
+		if network == "unix" {
+			addr = filepath.Join(dir, "lmtp")
+		}
+		server := newFakeLMTP(t, network, addr)
+		defer server.Close()
+
+		lmtp, err := newLMTPDepositor(LMTPConfig{
+			Network:  network,
+			Addr:     server.Addr(),
+			Timeout:  5 * time.Second,
+			Hostname: "formsink.vczf.io",
+		})
+		require.Nil(t, err)
+
+		msg := formMessage("contact")
+		require.Nil(t, depositMessage(lmtp, msg), network)
+
+		server.mu.Lock()
+		assert.Equal(t, "formsink.vczf.io", server.lhlo)
+		assert.Equal(t, msg.From.Address, server.from)
+		assert.Equal(t, []string{msg.To[0].Address, "archive@vczf.io", "audit@vczf.io"}, server.rcpts)
+		assert.Contains(t, server.data, "Subject: contact request")
+		assert.NotContains(t, server.data, "audit@vczf.io")
+		server.mu.Unlock()
+	}
+}
+
+func TestLMTPRecipientErrors(t *testing.T) {
+	to := simpleMessage().To[0].Address
+	cases := []struct {
+		rcptReply map[string]string
+		dataReply map[string]string
+		failures  []string // nil if the message was delivered
+		partial   bool     // Only failures should get it again
+		temporary bool
+		rset      bool
+	}{
+		// Over quota after DATA, while the others receive it, so only
+		// that one should get it again
+		{
+			dataReply: map[string]string{"archive@vczf.io": "452 4.2.2 Mailbox is full"},
+			failures:  []string{"archive@vczf.io"},
+			partial:   true,
+			temporary: true,
+		},
+		// Unknown user at RCPT, and over quota after DATA
+		{
+			rcptReply: map[string]string{"audit@vczf.io": "550 5.1.1 User doesn't exist"},
+			dataReply: map[string]string{"archive@vczf.io": "452 4.2.2 Mailbox is full"},
+			failures:  []string{"archive@vczf.io"},
+			partial:   true,
+			temporary: true,
+		},
+		// Unknown user at RCPT, while the others receive it
+		{
+			rcptReply: map[string]string{"audit@vczf.io": "550 5.1.1 User doesn't exist"},
+		},
+		// Every recipient over quota after DATA, one of them for good
+		{
+			dataReply: map[string]string{
+				to:                "452 4.2.2 Mailbox is full",
+				"archive@vczf.io": "452 4.2.2 Mailbox is full",
+				"audit@vczf.io":   "552 5.2.2 Mailbox is full",
+			},
+			failures:  []string{to, "archive@vczf.io"},
+			partial:   true,
+			temporary: true,
+		},
+		// Every recipient over quota after DATA for good
+		{
+			dataReply: map[string]string{
+				to:                "552 5.2.2 Mailbox is full",
+				"archive@vczf.io": "552 5.2.2 Mailbox is full",
+				"audit@vczf.io":   "552 5.2.2 Mailbox is full",
+			},
+			failures:  []string{to, "archive@vczf.io", "audit@vczf.io"},
+			temporary: false,
+		},
+		// Every recipient refused, so there's nothing to send
+		{
+			rcptReply: map[string]string{
+				to:                "451 4.3.0 Try again",
+				"archive@vczf.io": "451 4.3.0 Try again",
+				"audit@vczf.io":   "451 4.3.0 Try again",
+			},
+			failures:  []string{to, "archive@vczf.io", "audit@vczf.io"},
+			temporary: true,
+			rset:      true,
+		},
+	}
+
+	for _, c := range cases {
+		server := newFakeLMTP(t, "tcp", "127.0.0.1:0")
+		defer server.Close()
+		for rcpt, reply := range c.rcptReply {
+			server.rcptReply[rcpt] = reply
+		}
+		for rcpt, reply := range c.dataReply {
+			server.dataReply[rcpt] = reply
+		}
+
+		lmtp, err := newLMTPDepositor(LMTPConfig{Addr: server.Addr(), Timeout: 5 * time.Second})
+		require.Nil(t, err)
+
+		err = depositMessage(lmtp, formMessage("contact"))
+		if c.failures == nil {
+			assert.Nil(t, err)
+			continue
+		}
+		assert.Equal(t, c.temporary, isTemporary(err))
+		var failures DeliveryErrors
+		if c.partial {
+			require.IsType(t, &PartialDeliveryError{}, err)
+			failures = err.(*PartialDeliveryError).Failures
+			assert.Equal(t, c.failures, err.(*PartialDeliveryError).Recipients())
+		} else {
+			require.IsType(t, DeliveryErrors{}, err)
+			failures = err.(DeliveryErrors)
+		}
+
+		recipients := []string{}
+		for _, failure := range failures {
+			recipients = append(recipients, failure.Recipient)
+		}
+		assert.Equal(t, c.failures, recipients)
+
+		server.mu.Lock()
+		assert.Equal(t, c.rset, server.rset)
+		assert.Equal(t, c.rset, server.data == "")
+		server.mu.Unlock()
+	}
+}
+
+func TestLMTPErrors(t *testing.T) {
+	// Nothing listening
+	lmtp, err := newLMTPDepositor(LMTPConfig{Addr: "127.0.0.1:1", Timeout: time.Second})
+	require.Nil(t, err)
+	assert.NotNil(t, depositMessage(lmtp, simpleMessage()))
+
+	// Bad configuration
+	for _, config := range []LMTPConfig{
+		LMTPConfig{},
+		LMTPConfig{Network: "udp", Addr: "localhost:24"},
+	} {
+		_, err := newLMTPDepositor(config)
+		assert.NotNil(t, err)
+	}
+}
+
+// Temporary failures are 503 Service Unavailable, so the submitter knows to
+// try again, while permanent ones are 500 Internal Server Error.
+func TestLMTPStatus(t *testing.T) {
+	cases := []struct {
+		reply  string
+		status int
+	}{
+		{"452 4.2.2 Mailbox is full", http.StatusServiceUnavailable},
+		{"552 5.2.2 Mailbox is full", http.StatusInternalServerError},
+	}
+
+	for _, c := range cases {
+		server := newFakeLMTP(t, "tcp", "127.0.0.1:0")
+		defer server.Close()
+		server.dataReply[simpleMessage().To[0].Address] = c.reply
+
+		lmtp, err := newLMTPDepositor(LMTPConfig{Addr: server.Addr(), Timeout: 5 * time.Second})
+		require.Nil(t, err)
+		sink, err := newSink(lmtp, Config{Redirect: location}, simpleForm)
+		require.Nil(t, err)
+
+		result := post(t, sink)
+		assert.Equal(t, c.status, result.StatusCode, c.reply)
+	}
+}
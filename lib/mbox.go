@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jpoehls/gophermail"
+)
+
+// The date in an mbox "From " line, as written by asctime(3).
+const mboxDateLayout = "Mon Jan _2 15:04:05 2006"
+
+// mboxDepositor appends messages to an mbox file in the mboxrd format,
+// where lines of a message that look like "From " lines, quoted or not,
+// get one more ">" so that they can be told apart from the real ones.
+//
+// Writes are serialized within the process and the file is locked while
+// they happen, so that other programs reading or writing it, such as mail
+// clients, don't see a partial message.
+type mboxDepositor struct {
+	path    string
+	perForm bool // Whether path is a directory of one mbox per form
+
+	mu sync.Mutex
+}
+
+func newMboxDepositor(path string, perForm bool) (*mboxDepositor, error) {
+	if perForm {
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &mboxDepositor{path: path, perForm: perForm}, nil
+}
+
+func (m *mboxDepositor) Deposit(ctx context.Context, s *Submission) error {
+	raw, err := s.Message.Bytes()
+	if err != nil {
+		return err
+	}
+
+	return m.DepositRaw(ctx, s.Message, raw)
+}
+
+func (m *mboxDepositor) DepositRaw(ctx context.Context, msg *gophermail.Message, raw []byte) error {
+	path := m.path
+	if m.perForm {
+		name, err := formName(msg)
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(m.path, name+".mbox")
+	}
+
+	entry := &bytes.Buffer{}
+	writeMboxrd(entry, msg.From.Address, time.Now(), raw)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return e("locking mbox %q: %v", path, err)
+	}
+	defer unlockFile(f)
+
+	_, err = f.Write(entry.Bytes())
+	return err
+}
+
+// writeMboxrd writes raw as an mboxrd entry: a "From " line, the message
+// with LF line endings and its "From " lines quoted, then a blank line.
+func writeMboxrd(buf *bytes.Buffer, sender string, date time.Time, raw []byte) {
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	buf.WriteString("From " + sender + " " + date.UTC().Format(mboxDateLayout) + "\n")
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(nil, len(raw)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\r"))
+		if isFromLine(line) {
+			buf.WriteByte('>')
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+}
+
+// isFromLine reports whether line matches ^>*From , i.e. whether it needs
+// quoting in mboxrd.
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
+
+// formName returns the name of the form msg was submitted through, making
+// sure it's safe to use as a file name.
+func formName(msg *gophermail.Message) (string, error) {
+	name := msg.Headers.Get(formHeader)
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", e("can't store messages of form %q separately", name)
+	}
+	return name, nil
+}
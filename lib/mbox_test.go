@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteMboxrd(t *testing.T) {
+	raw := "Subject: hi\r\n\r\nFrom the top\r\n>From a quote\r\n>>From deeper\r\nNot From here\r\nFromage\r\n"
+	date := time.Date(2017, time.March, 4, 5, 6, 7, 0, time.UTC)
+
+	buf := &bytes.Buffer{}
+	writeMboxrd(buf, "crasm@vczf.io", date, []byte(raw))
+	assert.Equal(t, "From crasm@vczf.io Sat Mar  4 05:06:07 2017\n"+
+		"Subject: hi\n"+
+		"\n"+
+		">From the top\n"+
+		">>From a quote\n"+
+		">>>From deeper\n"+
+		"Not From here\n"+
+		"Fromage\n"+
+		"\n", buf.String())
+
+	buf.Reset()
+	writeMboxrd(buf, "", date, []byte("Subject: hi\r\n\r\nno newline"))
+	assert.Equal(t, "From MAILER-DAEMON Sat Mar  4 05:06:07 2017\nSubject: hi\n\nno newline\n\n", buf.String())
+}
+
+// Messages deposited at the same time aren't interleaved.
+func TestMbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "formsink.mbox")
+	mbox, err := newMboxDepositor(path, false)
+	require.Nil(t, err)
+
+	const count = 20
+	wg := sync.WaitGroup{}
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := formMessage("contact")
+			msg.Body = strings.Repeat("From the top\n", 1000)
+			assert.Nil(t, depositMessage(mbox, msg))
+		}()
+	}
+	wg.Wait()
+
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	entries := strings.Split(string(data), "\n\nFrom "+simpleMessage().From.Address+" ")
+	assert.Equal(t, count, len(entries))
+	for _, entry := range entries {
+		assert.NotContains(t, entry, "\nFrom ")
+		assert.NotContains(t, entry, "\r")
+	}
+}
+
+func TestMboxPerForm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	mbox, err := newMboxDepositor(filepath.Join(dir, "forms"), true)
+	require.Nil(t, err)
+
+	require.Nil(t, depositMessage(mbox, formMessage("contact")))
+	require.Nil(t, depositMessage(mbox, formMessage("survey")))
+	require.Nil(t, depositMessage(mbox, formMessage("contact")))
+
+	contact, err := ioutil.ReadFile(filepath.Join(dir, "forms", "contact.mbox"))
+	require.Nil(t, err)
+	assert.Equal(t, 2, strings.Count(string(contact), "X-Formsink-Form: contact"))
+	assert.NotContains(t, string(contact), "survey")
+
+	survey, err := ioutil.ReadFile(filepath.Join(dir, "forms", "survey.mbox"))
+	require.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(string(survey), "X-Formsink-Form: survey"))
+
+	for _, name := range []string{"", "..", "../contact", "a/b"} {
+		assert.NotNil(t, depositMessage(mbox, formMessage(name)), name)
+	}
+}
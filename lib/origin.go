@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// anyOrigin in an allowlist lets forms be submitted from any site.
+const anyOrigin = "*"
+
+// defaultPorts are left out of origins, as browsers do in Origin headers.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// parseOrigin returns the origin of an absolute http or https URL, e.g.
+// "https://example.com" for "https://Example.com:443/contact.html".
+func parseOrigin(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", e("invalid origin %q: %v", rawurl, err)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if _, ok := defaultPorts[scheme]; !ok || u.Host == "" {
+		return "", e("invalid origin %q, expected e.g. 'https://example.com'", rawurl)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[scheme] {
+		host += ":" + port
+	}
+	return scheme + "://" + host, nil
+}
+
+// parseOrigins parses a list of origins, keeping anyOrigin as it is.
+func parseOrigins(list []string) ([]string, error) {
+	origins := make([]string, 0, len(list))
+	for _, item := range list {
+		if item == anyOrigin {
+			origins = append(origins, item)
+			continue
+		}
+		origin, err := parseOrigin(item)
+		if err != nil {
+			return nil, err
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
+}
+
+// pageOrigin returns the origin of the site a page is published on, taken
+// from its <base href>, <link rel='canonical'> or og:url, or "" if it
+// has none of them.
+func pageOrigin(doc *goquery.Document) string {
+	candidates := []string{
+		doc.Find("base[href]").First().AttrOr("href", ""),
+		doc.Find("link[rel~='canonical'][href]").First().AttrOr("href", ""),
+		doc.Find("meta[property='og:url'][content]").First().AttrOr("content", ""),
+	}
+	for _, candidate := range candidates {
+		if origin, err := parseOrigin(candidate); err == nil {
+			return origin
+		}
+	}
+	return ""
+}
+
+// checkOrigin returns an error if r was sent from a site that form may
+// not be submitted from, going by its Origin header, or else its Referer
+// or Sec-Fetch-Site headers. Submissions are always allowed from formsink
+// itself, and only checked at all if form or allowed list any origins.
+//
+// Requests without any of these headers aren't sent by browsers on behalf
+// of another site, so they're allowed.
+func checkOrigin(r *http.Request, form *Form, allowed []string) error {
+	origins := append(append([]string{}, form.Origins...), allowed...)
+	if len(origins) == 0 || contains(origins, anyOrigin) {
+		return nil
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		if referer := r.Header.Get("Referer"); referer != "" {
+			// A Referer without an origin, e.g. from a file:// page,
+			// fails below just like Origin: null does.
+			origin, _ = parseOrigin(referer)
+			if origin == "" {
+				origin = "null"
+			}
+		}
+	}
+	if origin == "" {
+		if site := r.Header.Get("Sec-Fetch-Site"); site == "cross-site" {
+			return e("cross-site submission without an origin")
+		}
+		return nil
+	}
+
+	normalized, err := parseOrigin(origin)
+	if err != nil {
+		return e("submission from origin %q", origin)
+	}
+	if contains(origins, normalized) {
+		return nil
+	}
+	// Formsink's own origin takes the scheme of the submission's, since
+	// it may be behind a proxy terminating TLS.
+	scheme := normalized[:strings.Index(normalized, "://")]
+	if own, err := parseOrigin(scheme + "://" + r.Host); err == nil && own == normalized {
+		return nil
+	}
+	return e("submission from origin %q", origin)
+}
@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOrigin(t *testing.T) {
+	cases := map[string]string{
+		"https://example.com":                    "https://example.com",
+		"HTTPS://Example.COM:443/contact.html":   "https://example.com",
+		"http://example.com:80":                  "http://example.com",
+		"http://example.com:8080/?q#frag":        "http://example.com:8080",
+		"https://user@example.com/":              "https://example.com",
+		"http://[2001:db8::1]:8443/contact.html": "http://[2001:db8::1]:8443",
+	}
+	for rawurl, origin := range cases {
+		parsed, err := parseOrigin(rawurl)
+		require.Nil(t, err, rawurl)
+		assert.Equal(t, origin, parsed, rawurl)
+	}
+
+	for _, rawurl := range []string{"", "null", "example.com", "/contact", "ftp://example.com", "file:///srv/www/contact.html"} {
+		_, err := parseOrigin(rawurl)
+		assert.NotNil(t, err, rawurl)
+	}
+}
+
+func TestPageOrigin(t *testing.T) {
+	pages := map[string]string{
+		`<link rel='canonical' href='https://example.com/contact.html'>`:             "https://example.com",
+		`<link rel='alternate canonical' href='https://example.com/contact.html'>`:   "https://example.com",
+		`<base href='/'><meta property='og:url' content='https://www.example.com/'>`: "https://www.example.com",
+		`<base href='https://example.com/en/'>`:                                      "https://example.com",
+		`<link rel='stylesheet' href='https://cdn.example.net/site.css'>`:            "",
+		``: "",
+	}
+	for head, origin := range pages {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(
+			"<html><head>" + head + "</head><body><form action='/contact'></form></body></html>"))
+		require.Nil(t, err)
+		assert.Equal(t, origin, pageOrigin(doc), head)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	form := *simpleForm
+	form.Origins = []string{"https://example.com"}
+	sink, err := newSink(&mockDepositor{}, Config{AllowedOrigins: []string{"https://partner.example.net"}}, &form)
+	require.Nil(t, err)
+
+	cases := []struct {
+		headers map[string]string
+		status  int
+	}{
+		{map[string]string{}, http.StatusNoContent},
+		{map[string]string{"Origin": "https://example.com"}, http.StatusNoContent},
+		{map[string]string{"Origin": "https://partner.example.net"}, http.StatusNoContent},
+		{map[string]string{"Origin": "https://formsink.example.com"}, http.StatusNoContent},
+		{map[string]string{"Origin": "https://evil.example.org"}, http.StatusForbidden},
+		{map[string]string{"Origin": "http://example.com"}, http.StatusForbidden},
+		{map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{map[string]string{"Referer": "https://example.com/contact.html"}, http.StatusNoContent},
+		{map[string]string{"Referer": "https://evil.example.org/contact.html"}, http.StatusForbidden},
+		{map[string]string{"Referer": "file:///home/crasm/contact.html"}, http.StatusForbidden},
+		{map[string]string{"Sec-Fetch-Site": "same-site"}, http.StatusNoContent},
+		{map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{map[string]string{
+			"Origin":  "https://evil.example.org",
+			"Referer": "https://example.com/contact.html",
+		}, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		body := url.Values{"name": {"crasm"}}.Encode()
+		r := httptest.NewRequest(http.MethodPost, "https://formsink.example.com/contact", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for name, value := range c.headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		sink.ServeHTTP(w, r)
+		assert.Equal(t, c.status, w.Code, "%v", c.headers)
+	}
+}
+
+// Forms are only checked once there are origins to check against.
+func TestOriginUnchecked(t *testing.T) {
+	for _, allowed := range [][]string{nil, {"https://example.com", "*"}} {
+		sink, err := newSink(&mockDepositor{}, Config{AllowedOrigins: allowed}, simpleForm)
+		require.Nil(t, err)
+
+		body := url.Values{"name": {"crasm"}}.Encode()
+		r := httptest.NewRequest(http.MethodPost, "/contact", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "https://evil.example.org")
+		w := httptest.NewRecorder()
+		sink.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNoContent, w.Code, "%v", allowed)
+	}
+
+	_, err := newSink(&mockDepositor{}, Config{AllowedOrigins: []string{"example.com"}}, simpleForm)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,208 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+)
+
+// parseSubmission reads the submitted values and files from the request
+// body according to its Content-Type. Bodies without files are returned as
+// a *multipart.Form with an empty File map so that every encoding is
+// handled the same way afterwards. Multipart bodies are held to limits as
+// they're read.
+//
+// On failure, the returned status is the one to respond with.
+func parseSubmission(r *http.Request, limits Limits) (*multipart.Form, int, error) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return nil, http.StatusUnsupportedMediaType, e("missing Content-Type")
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	switch mediaType {
+	case "multipart/form-data":
+		form, err := parseMultipart(r, limits)
+		if err != nil {
+			return nil, parseErrorStatus(err), err
+		}
+		return form, 0, nil
+
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return nil, parseErrorStatus(err), err
+		}
+		return &multipart.Form{
+			Value: r.PostForm,
+			File:  map[string][]*multipart.FileHeader{},
+		}, 0, nil
+
+	case "application/json":
+		values, err := parseJSON(r)
+		if err != nil {
+			return nil, parseErrorStatus(err), err
+		}
+		return &multipart.Form{
+			Value: values,
+			File:  map[string][]*multipart.FileHeader{},
+		}, 0, nil
+	}
+
+	return nil, http.StatusUnsupportedMediaType, e("unsupported Content-Type %q", mediaType)
+}
+
+// parseErrorStatus distinguishes bodies cut off by http.MaxBytesReader
+// from malformed ones.
+func parseErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	var exceeded *limitError
+	if errors.As(err, &tooLarge) || errors.As(err, &exceeded) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// parseMultipart reads a multipart/form-data body like ParseMultipartForm
+// does, except that each file and field is cut off as soon as it exceeds
+// its limit, and so are uploads once there are too many files, rather than
+// only being checked once they're in memory or temporary files.
+//
+// The parts are streamed through a pipe to multipart.Reader.ReadForm,
+// which is the only way to get a *multipart.Form holding them.
+func parseMultipart(r *http.Request, limits Limits) (*multipart.Form, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	copied := make(chan error, 1)
+	go func() {
+		err := copyParts(mw, reader, limits)
+		pw.CloseWithError(err)
+		copied <- err
+	}()
+
+	form, err := multipart.NewReader(pr, mw.Boundary()).ReadForm(defaultMaxMemory)
+	// Stops the copy if ReadForm failed first, so that it's done with the
+	// body before the handler returns.
+	pr.Close()
+	if copyErr := <-copied; copyErr != nil && copyErr != io.ErrClosedPipe {
+		if form != nil {
+			form.RemoveAll()
+		}
+		return nil, copyErr
+	}
+	return form, err
+}
+
+// copyParts copies the parts read by reader to mw, up to limits.
+func copyParts(mw *multipart.Writer, reader *multipart.Reader, limits Limits) error {
+	files := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return mw.Close()
+		}
+		if err != nil {
+			return err
+		}
+
+		limit := limits.MaxFieldSize
+		if part.FileName() != "" {
+			files++
+			if limits.MaxFiles > 0 && files > limits.MaxFiles {
+				return &limitError{e("more than %d files uploaded", limits.MaxFiles)}
+			}
+			limit = limits.MaxFileSize
+		}
+
+		w, err := mw.CreatePart(part.Header)
+		if err != nil {
+			return err
+		}
+		var contents io.Reader = part
+		if limit > 0 {
+			contents = io.LimitReader(part, limit+1)
+		}
+		n, err := io.Copy(w, contents)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case limit <= 0 || n <= limit:
+		case part.FileName() != "":
+			return &limitError{e("file %q in %q is larger than %d bytes", part.FileName(), part.FormName(), limit)}
+		default:
+			return &limitError{e("field %q is longer than %d bytes", part.FormName(), limit)}
+		}
+	}
+}
+
+// parseJSON reads a flat JSON object, such as one built from FormData by
+// fetch()-based forms. Each member must be a string, number, boolean or
+// null, or an array of those for multi-valued fields.
+func parseJSON(r *http.Request) (map[string][]string, error) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+
+	object := map[string]interface{}{}
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+
+	values := map[string][]string{}
+	for name, member := range object {
+		if array, ok := member.([]interface{}); ok {
+			for _, element := range array {
+				value, err := jsonScalar(name, element)
+				if err != nil {
+					return nil, err
+				}
+				if value != nil {
+					values[name] = append(values[name], *value)
+				}
+			}
+			continue
+		}
+
+		value, err := jsonScalar(name, member)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			values[name] = append(values[name], *value)
+		}
+	}
+
+	return values, nil
+}
+
+// jsonScalar formats a decoded JSON value as a form value, returning nil
+// for null.
+func jsonScalar(name string, v interface{}) (*string, error) {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	case bool:
+		s = fmt.Sprint(v)
+	default:
+		return nil, e("unsupported JSON value for %q", name)
+	}
+	return &s, nil
+}
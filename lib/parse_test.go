@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Sends body to the form at path and returns the response.
+func submit(t *testing.T, sink http.Handler, path, contentType, body string) *http.Response {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	sink.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func TestURLEncoded(t *testing.T) {
+	mockDepositor := &mockDepositor{}
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, simpleForm)
+	require.Nil(t, err)
+
+	result := submit(t, sink, "/contact", "application/x-www-form-urlencoded",
+		"name=crasm&email=crasm%40formsink.email.vczf.io&message=I+%26%239829%3B+formsink%21")
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+
+	require.NotNil(t, mockDepositor.msg)
+	assert.Equal(t, simpleMessage().Body, mockDepositor.msg.Body)
+	assert.Empty(t, mockDepositor.msg.Attachments)
+}
+
+func TestJSON(t *testing.T) {
+	mockDepositor := &mockDepositor{}
+	form := &Form{
+		Name:     "contact",
+		Fields:   []string{"name", "age", "subscribe", "topics", "message"},
+		Multiple: map[string]bool{"topics": true},
+	}
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, form)
+	require.Nil(t, err)
+
+	result := submit(t, sink, "/contact", "application/json; charset=utf-8",
+		`{"name": "crasm", "age": 30, "subscribe": true, "topics": ["go", "html"], "message": null}`)
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+
+	require.NotNil(t, mockDepositor.msg)
+	assert.Equal(t,
+		"name: crasm\nage: 30\nsubscribe: true\ntopics: go\ntopics: html\nmessage: \n",
+		mockDepositor.msg.Body)
+}
+
+func TestBadBody(t *testing.T) {
+	cases := []struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		{"", "name=crasm", http.StatusUnsupportedMediaType},
+		{"text/plain", "name=crasm", http.StatusUnsupportedMediaType},
+		{"multipart/form-data", "name=crasm", http.StatusBadRequest}, // No boundary
+		{"multipart/form-data; boundary=xyz", "name=crasm", http.StatusBadRequest},
+		{"application/json", `{"name": `, http.StatusBadRequest},
+		{"application/json", `["crasm"]`, http.StatusBadRequest},
+		{"application/json", `{"name": {"first": "crasm"}}`, http.StatusBadRequest},
+		{"application/json", `{"name": [["crasm"]]}`, http.StatusBadRequest},
+		{"application/x-www-form-urlencoded", "name=%zz", http.StatusBadRequest},
+		{"; charset=utf-8", "name=crasm", http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		mockDepositor := &mockDepositor{}
+		sink, err := newSink(mockDepositor, Config{Redirect: location}, simpleForm)
+		require.Nil(t, err)
+
+		result := submit(t, sink, "/contact", c.contentType, c.body)
+		assert.Equal(t, c.status, result.StatusCode, "%q %q", c.contentType, c.body)
+		assert.Nil(t, mockDepositor.msg)
+	}
+}
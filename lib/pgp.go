@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	_ "crypto/sha256" // The hash preferred by most keys, for openpgp.Encrypt
+	"fmt"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	_ "golang.org/x/crypto/ripemd160" // The hash for keys without preferences
+)
+
+// The subject of encrypted messages, as suggested by the "Protected
+// Headers for Cryptographic E-mail" draft. The real subject is inside of
+// the encrypted part.
+const encryptedSubject = "..."
+
+// Headers that may contain what was submitted and so are moved into the
+// encrypted part of the message.
+var protectedHeaders = []string{"Subject", "Reply-To"}
+
+// pgpDepositor encrypts messages to one or more public keys as PGP/MIME
+// (RFC 3156) before passing them on, so that neither the body nor the
+// attachments are stored in plaintext.
+type pgpDepositor struct {
+	next       RawDepositor
+	recipients openpgp.EntityList
+}
+
+func newPGPDepositor(next RawDepositor, recipients openpgp.EntityList) *pgpDepositor {
+	return &pgpDepositor{next, recipients}
+}
+
+// readArmoredKeys reads the ASCII-armored public keys in each file.
+func readArmoredKeys(filenames ...string) (openpgp.EntityList, error) {
+	keys := openpgp.EntityList{}
+	for _, filename := range filenames {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		entities, err := openpgp.ReadArmoredKeyRing(f)
+		f.Close()
+		if err != nil {
+			return nil, e("reading public key %q: %v", filename, err)
+		}
+		keys = append(keys, entities...)
+	}
+
+	if len(keys) < 1 {
+		return nil, e("no public keys to encrypt to")
+	}
+	return keys, nil
+}
+
+func (p *pgpDepositor) Deposit(ctx context.Context, s *Submission) error {
+	raw, err := s.Message.Bytes()
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := p.encrypt(raw)
+	if err != nil {
+		return err
+	}
+
+	return p.next.DepositRaw(ctx, s.Message, encrypted)
+}
+
+// encrypt turns an encoded message into a multipart/encrypted one. The
+// original body, along with its Content-Type and protected headers,
+// becomes the encrypted part.
+func (p *pgpDepositor) encrypt(raw []byte) ([]byte, error) {
+	original, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the MIME entity to be encrypted.
+	plaintext := &bytes.Buffer{}
+	fmt.Fprintf(plaintext, "Content-Type: %s\r\n", original.Header.Get("Content-Type"))
+	for _, key := range protectedHeaders {
+		if value := original.Header.Get(key); value != "" {
+			fmt.Fprintf(plaintext, "%s: %s\r\n", key, value)
+		}
+	}
+	plaintext.WriteString("\r\n")
+	if _, err := plaintext.ReadFrom(original.Body); err != nil {
+		return nil, err
+	}
+
+	ciphertext := &bytes.Buffer{}
+	armored, err := armor.Encode(ciphertext, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	w, err := openpgp.Encrypt(armored, p.recipients, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := armored.Close(); err != nil {
+		return nil, err
+	}
+
+	// Build the multipart/encrypted message around it.
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"application/pgp-encrypted"},
+		"Content-Description": {"PGP/MIME version identification"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	part.Write([]byte("Version: 1\r\n"))
+
+	part, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {`application/octet-stream; name="encrypted.asc"`},
+		"Content-Description": {"OpenPGP encrypted message"},
+		"Content-Disposition": {`inline; filename="encrypted.asc"`},
+	})
+	if err != nil {
+		return nil, err
+	}
+	part.Write(ciphertext.Bytes())
+	part.Write([]byte("\r\n"))
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	// Copy the remaining headers, in a stable order.
+	header := textproto.MIMEHeader(original.Header)
+	hasSubject := header.Get("Subject") != ""
+	for _, key := range protectedHeaders {
+		header.Del(key)
+	}
+	if hasSubject {
+		header.Set("Subject", encryptedSubject)
+	}
+	header.Set("Content-Type", fmt.Sprintf(
+		`multipart/encrypted; protocol="application/pgp-encrypted"; boundary="%s"`, mw.Boundary()))
+
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	encrypted := &bytes.Buffer{}
+	for _, key := range keys {
+		for _, value := range header[key] {
+			fmt.Fprintf(encrypted, "%s: %s\r\n", key, value)
+		}
+	}
+	encrypted.WriteString("\r\n")
+	encrypted.Write(body.Bytes())
+
+	return encrypted.Bytes(), nil
+}
@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jpoehls/gophermail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+type mockRawDepositor struct {
+	mockDepositor
+	raw []byte
+}
+
+func (m *mockRawDepositor) DepositRaw(ctx context.Context, msg *gophermail.Message, raw []byte) error {
+	m.msg = msg
+	m.raw = raw
+	return nil
+}
+
+// Generates a test key and writes its public half to a file in dir.
+func testKey(t *testing.T, dir string) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity("FormSink Test", "", "test@formsink.email.vczf.io",
+		&packet.Config{RSABits: 1024}) // Small for speed
+	require.Nil(t, err)
+
+	filename := filepath.Join(dir, "test.asc")
+	f, err := os.Create(filename)
+	require.Nil(t, err)
+	defer f.Close()
+
+	w, err := armor.Encode(f, openpgp.PublicKeyType, nil)
+	require.Nil(t, err)
+	require.Nil(t, entity.Serialize(w))
+	require.Nil(t, w.Close())
+
+	return entity, filename
+}
+
+func TestPGP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	entity, filename := testKey(t, dir)
+	keys, err := readArmoredKeys(filename)
+	require.Nil(t, err)
+
+	mock := &mockRawDepositor{}
+	msg := simpleMessage()
+	require.Nil(t, depositMessage(newPGPDepositor(mock, keys), msg))
+	require.NotNil(t, mock.raw)
+
+	// Nothing submitted is in plaintext.
+	for _, secret := range []string{"crasm@formsink", "formsink!", "contact request"} {
+		assert.NotContains(t, string(mock.raw), secret)
+	}
+
+	outer, err := mail.ReadMessage(bytes.NewReader(mock.raw))
+	require.Nil(t, err)
+	assert.Equal(t, "...", outer.Header.Get("Subject"))
+	assert.Equal(t, "", outer.Header.Get("Reply-To"))
+	assert.Contains(t, outer.Header.Get("From"), "FormSink@")
+
+	mediaType, params, err := mime.ParseMediaType(outer.Header.Get("Content-Type"))
+	require.Nil(t, err)
+	assert.Equal(t, "multipart/encrypted", mediaType)
+	assert.Equal(t, "application/pgp-encrypted", params["protocol"])
+
+	parts := multipart.NewReader(outer.Body, params["boundary"])
+	version, err := parts.NextPart()
+	require.Nil(t, err)
+	assert.Equal(t, "application/pgp-encrypted", version.Header.Get("Content-Type"))
+
+	encrypted, err := parts.NextPart()
+	require.Nil(t, err)
+	block, err := armor.Decode(encrypted)
+	require.Nil(t, err)
+	details, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+	require.Nil(t, err)
+
+	inner, err := mail.ReadMessage(details.UnverifiedBody)
+	require.Nil(t, err)
+	assert.Equal(t, "contact request", inner.Header.Get("Subject"))
+	assert.Equal(t, "<crasm@formsink.email.vczf.io>", inner.Header.Get("Reply-To"))
+
+	mediaType, params, err = mime.ParseMediaType(inner.Header.Get("Content-Type"))
+	require.Nil(t, err)
+	assert.Equal(t, "multipart/mixed", mediaType)
+
+	// The body, then the attachment.
+	mixed := multipart.NewReader(inner.Body, params["boundary"])
+	body, err := mixed.NextPart()
+	require.Nil(t, err)
+	text, err := ioutil.ReadAll(body)
+	require.Nil(t, err)
+	assert.Contains(t, string(text), "crasm@formsink.email.vczf.io")
+
+	attachment, err := mixed.NextPart()
+	require.Nil(t, err)
+	assert.Equal(t, "tiny.ppm", attachment.FileName())
+	data, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, attachment))
+	require.Nil(t, err)
+	tiny, err := ioutil.ReadFile("../resources/tiny.ppm")
+	require.Nil(t, err)
+	assert.Equal(t, tiny, data)
+}
+
+func TestReadArmoredKeysError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	garbage := filepath.Join(dir, "garbage.asc")
+	require.Nil(t, ioutil.WriteFile(garbage, []byte("not a key"), 0600))
+
+	for _, filenames := range [][]string{
+		nil,
+		[]string{filepath.Join(dir, "missing.asc")},
+		[]string{garbage},
+	} {
+		_, err := readArmoredKeys(filenames...)
+		assert.NotNil(t, err, strings.Join(filenames, ","))
+	}
+}
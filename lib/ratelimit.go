@@ -0,0 +1,267 @@
+package lib
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRateLimitMaxClients = 10000
+
+// RateLimitConfig limits how often forms can be submitted. Each limit is a
+// token bucket, so that short bursts are allowed while sustained floods
+// are turned away with 429 Too Many Requests.
+type RateLimitConfig struct {
+	// PerClient limits the submissions from each client IP address to any
+	// form, PerForm the submissions to each form from anyone, and Global
+	// all submissions. Zero Rates don't limit anything.
+	PerClient Rate
+	PerForm   Rate
+	Global    Rate
+
+	// TrustedProxies are the IP addresses or CIDR networks of reverse
+	// proxies whose X-Forwarded-For headers are believed, e.g.
+	// "127.0.0.1" or "10.0.0.0/8".
+	TrustedProxies []string
+
+	// MaxClients bounds how many clients are kept track of. Clients that
+	// have been idle long enough to be allowed a full burst again are
+	// forgotten first, then those idle the longest. Defaults to 10000.
+	MaxClients int
+}
+
+// Rate allows Count submissions per Per, in bursts of up to Count.
+type Rate struct {
+	Count int
+	Per   time.Duration
+}
+
+// ParseRate parses a rate such as "10/1h", or "" for no limit.
+func ParseRate(s string) (Rate, error) {
+	if s == "" {
+		return Rate{}, nil
+	}
+	slash := strings.Index(s, "/")
+	if slash < 0 {
+		return Rate{}, e("expected a rate such as '10/1h', got %q", s)
+	}
+	count, err := strconv.Atoi(s[:slash])
+	if err != nil || count < 1 {
+		return Rate{}, e("invalid count in rate %q", s)
+	}
+	per, err := time.ParseDuration(s[slash+1:])
+	if err != nil || per <= 0 {
+		return Rate{}, e("invalid duration in rate %q", s)
+	}
+	return Rate{count, per}, nil
+}
+
+func (r Rate) unlimited() bool {
+	return r.Count <= 0 || r.Per <= 0
+}
+
+// interval is how long it takes for a token to be added to a bucket.
+func (r Rate) interval() time.Duration {
+	return r.Per / time.Duration(r.Count)
+}
+
+// bucket is a token bucket, full when it's new.
+type bucket struct {
+	tokens float64
+	last   time.Time // When tokens was last brought up to date
+}
+
+func newBucket(rate Rate, now time.Time) *bucket {
+	return &bucket{float64(rate.Count), now}
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (b *bucket) refill(rate Rate, now time.Time) {
+	earned := float64(now.Sub(b.last)) / float64(rate.interval())
+	b.tokens = math.Min(float64(rate.Count), b.tokens+earned)
+	b.last = now
+}
+
+// wait returns how long until the bucket has a token, after refill.
+func (b *bucket) wait(rate Rate) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) * float64(rate.interval()))
+}
+
+// idle reports whether the bucket would be full by now, and so no
+// different from a new one.
+func (b *bucket) idle(rate Rate, now time.Time) bool {
+	return now.Sub(b.last) >= rate.Per
+}
+
+// rateLimiter enforces a RateLimitConfig.
+type rateLimiter struct {
+	config  RateLimitConfig
+	proxies []*net.IPNet
+	now     func() time.Time
+
+	mu      sync.Mutex
+	global  *bucket
+	forms   map[string]*bucket
+	clients map[string]*bucket
+}
+
+func newRateLimiter(config RateLimitConfig) (*rateLimiter, error) {
+	if config.MaxClients == 0 {
+		config.MaxClients = defaultRateLimitMaxClients
+	}
+
+	rl := &rateLimiter{
+		config:  config,
+		now:     time.Now,
+		forms:   map[string]*bucket{},
+		clients: map[string]*bucket{},
+	}
+	for _, proxy := range config.TrustedProxies {
+		cidr := proxy
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, e("invalid trusted proxy %q", proxy)
+		}
+		rl.proxies = append(rl.proxies, network)
+	}
+	return rl, nil
+}
+
+// enabled reports whether there are any limits at all.
+func (rl *rateLimiter) enabled() bool {
+	return !rl.config.PerClient.unlimited() || !rl.config.PerForm.unlimited() || !rl.config.Global.unlimited()
+}
+
+// allow takes a token for a submission to form from client out of each of
+// the buckets, or else returns how long until they all have one, without
+// taking any.
+func (rl *rateLimiter) allow(client, form string) (bool, time.Duration) {
+	now := rl.now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	type limit struct {
+		rate   Rate
+		bucket *bucket
+	}
+	limits := make([]limit, 0, 3)
+	if rate := rl.config.Global; !rate.unlimited() {
+		if rl.global == nil {
+			rl.global = newBucket(rate, now)
+		}
+		limits = append(limits, limit{rate, rl.global})
+	}
+	if rate := rl.config.PerForm; !rate.unlimited() {
+		if rl.forms[form] == nil {
+			rl.forms[form] = newBucket(rate, now)
+		}
+		limits = append(limits, limit{rate, rl.forms[form]})
+	}
+	if rate := rl.config.PerClient; !rate.unlimited() {
+		if rl.clients[client] == nil {
+			rl.makeRoom(now)
+			rl.clients[client] = newBucket(rate, now)
+		}
+		limits = append(limits, limit{rate, rl.clients[client]})
+	}
+
+	var wait time.Duration
+	for _, l := range limits {
+		l.bucket.refill(l.rate, now)
+		if w := l.bucket.wait(l.rate); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	for _, l := range limits {
+		l.bucket.tokens--
+	}
+	return true, 0
+}
+
+// makeRoom forgets idle clients if there's no room for another one, and
+// then the one idle the longest if there's still none.
+func (rl *rateLimiter) makeRoom(now time.Time) {
+	if len(rl.clients) < rl.config.MaxClients {
+		return
+	}
+
+	var oldest string
+	for client, b := range rl.clients {
+		if b.idle(rl.config.PerClient, now) {
+			delete(rl.clients, client)
+		} else if oldest == "" || b.last.Before(rl.clients[oldest].last) {
+			oldest = client
+		}
+	}
+	if len(rl.clients) >= rl.config.MaxClients {
+		delete(rl.clients, oldest)
+	}
+}
+
+// clientIP returns the address of whoever sent r. Requests from trusted
+// proxies are attributed to the last address in X-Forwarded-For that
+// isn't itself a trusted proxy.
+func (rl *rateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !rl.trusted(host) {
+		return host
+	}
+
+	forwarded := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break // Anything before it can't be trusted either
+		}
+		host = addr
+		if !rl.trusted(addr) {
+			break
+		}
+	}
+	return host
+}
+
+func (rl *rateLimiter) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range rl.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRetryAfter responds to r with 429 Too Many Requests, rounding wait
+// up to whole seconds for Retry-After.
+func writeRetryAfter(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	writeError(w, r, http.StatusTooManyRequests)
+}
@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a time that only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestParseRate(t *testing.T) {
+	rate, err := ParseRate("10/1h")
+	require.Nil(t, err)
+	assert.Equal(t, Rate{10, time.Hour}, rate)
+	assert.Equal(t, 6*time.Minute, rate.interval())
+
+	rate, err = ParseRate("")
+	require.Nil(t, err)
+	assert.True(t, rate.unlimited())
+
+	for _, s := range []string{"10", "0/1h", "x/1h", "10/", "10/-1s", "10/hour"} {
+		_, err := ParseRate(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	clock := &fakeClock{time.Now()}
+	rl, err := newRateLimiter(RateLimitConfig{
+		PerClient: Rate{2, time.Minute},
+		PerForm:   Rate{3, time.Minute},
+		Global:    Rate{100, time.Minute},
+	})
+	require.Nil(t, err)
+	rl.now = clock.now
+
+	// A client gets a burst, then one every 30 seconds.
+	for i := 0; i < 2; i++ {
+		ok, _ := rl.allow("192.0.2.1", "contact")
+		assert.True(t, ok, i)
+	}
+	ok, wait := rl.allow("192.0.2.1", "contact")
+	assert.False(t, ok)
+	assert.Equal(t, 30*time.Second, wait)
+
+	clock.t = clock.t.Add(30 * time.Second)
+	ok, _ = rl.allow("192.0.2.1", "contact")
+	assert.True(t, ok)
+
+	// The form has one token left, which a denied client doesn't take.
+	ok, _ = rl.allow("192.0.2.1", "contact")
+	assert.False(t, ok)
+	ok, _ = rl.allow("192.0.2.2", "contact")
+	assert.True(t, ok)
+	ok, wait = rl.allow("192.0.2.3", "contact")
+	assert.False(t, ok)
+	assert.Equal(t, 10*time.Second, wait)
+
+	ok, _ = rl.allow("192.0.2.3", "survey")
+	assert.True(t, ok, "forms are limited separately")
+}
+
+// Idle clients are forgotten before active ones.
+func TestRateLimiterMaxClients(t *testing.T) {
+	clock := &fakeClock{time.Now()}
+	rl, err := newRateLimiter(RateLimitConfig{PerClient: Rate{1, time.Minute}, MaxClients: 2})
+	require.Nil(t, err)
+	rl.now = clock.now
+
+	rl.allow("192.0.2.1", "contact")
+	clock.t = clock.t.Add(time.Minute)
+	rl.allow("192.0.2.2", "contact")
+	clock.t = clock.t.Add(time.Second)
+	rl.allow("192.0.2.3", "contact")
+	assert.Len(t, rl.clients, 2)
+	assert.Nil(t, rl.clients["192.0.2.1"])
+
+	clock.t = clock.t.Add(time.Second)
+	rl.allow("192.0.2.4", "contact")
+	assert.Len(t, rl.clients, 2)
+	assert.Nil(t, rl.clients["192.0.2.2"], "the oldest goes when none is idle")
+	ok, _ := rl.allow("192.0.2.3", "contact")
+	assert.False(t, ok)
+}
+
+func TestClientIP(t *testing.T) {
+	rl, err := newRateLimiter(RateLimitConfig{TrustedProxies: []string{"127.0.0.1", "10.0.0.0/8", "::1"}})
+	require.Nil(t, err)
+
+	cases := []struct {
+		remote    string
+		forwarded []string
+		client    string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"127.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"[::1]:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"127.0.0.1:1234", []string{"203.0.113.1, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"127.0.0.1:1234", []string{"203.0.113.1", "198.51.100.1"}, "198.51.100.1"},
+		{"127.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"127.0.0.1:1234", []string{"198.51.100.1, bogus"}, "127.0.0.1"},
+		{"127.0.0.1:1234", nil, "127.0.0.1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/contact", nil)
+		r.RemoteAddr = c.remote
+		for _, header := range c.forwarded {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		assert.Equal(t, c.client, rl.clientIP(r), c.forwarded)
+	}
+
+	_, err = newRateLimiter(RateLimitConfig{TrustedProxies: []string{"localhost"}})
+	assert.NotNil(t, err)
+}
+
+func TestRateLimit(t *testing.T) {
+	mock := &mockDepositor{}
+	sink, err := newSink(mock, Config{
+		Redirect:  location,
+		RateLimit: RateLimitConfig{PerClient: Rate{1, time.Hour}},
+	}, simpleForm)
+	require.Nil(t, err)
+
+	send := func(remote string) *http.Response {
+		body := url.Values{"name": {"crasm"}}.Encode()
+		r := httptest.NewRequest(http.MethodPost, "/contact", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		sink.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	assert.Equal(t, http.StatusSeeOther, send("192.0.2.1:1234").StatusCode)
+	mock.msg = nil
+	result := send("192.0.2.1:5678")
+	assert.Equal(t, http.StatusTooManyRequests, result.StatusCode)
+	retry, err := strconv.Atoi(result.Header.Get("Retry-After"))
+	require.Nil(t, err)
+	assert.InDelta(t, 3600, retry, 1)
+	assert.Nil(t, mock.msg)
+
+	assert.Equal(t, http.StatusSeeOther, send("192.0.2.2:1234").StatusCode)
+}
@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// corsMaxAge is how long browsers may cache a preflight response, in
+// seconds, which is as long as Chrome allows.
+const corsMaxAge = "7200"
+
+// submissionResponse is the body of responses to clients that accept JSON,
+// e.g. pages submitting forms with fetch(). Status is "ok" for accepted
+// submissions and "error" otherwise.
+type submissionResponse struct {
+	Status   string            `json:"status"`
+	ID       string            `json:"id,omitempty"`
+	Redirect string            `json:"redirect,omitempty"` // The form's confirmation or error page
+	Error    string            `json:"error,omitempty"`
+	Errors   map[string]string `json:"errors,omitempty"` // Reasons by field name
+}
+
+// wantsJSON reports whether r accepts application/json, in which case
+// it's answered with a submissionResponse rather than a redirect.
+func wantsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(mediaRange)
+			if err == nil && mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, response *submissionResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeError responds with status, as JSON if r accepts it.
+func writeError(w http.ResponseWriter, r *http.Request, status int) {
+	if !wantsJSON(r) {
+		writeStatus(w, status)
+		return
+	}
+	writeJSON(w, status, &submissionResponse{Status: "error", Error: http.StatusText(status)})
+}
+
+// corsAllowed reports whether pages from origin may read the responses
+// to the submissions they send, as listed in Config.CORSOrigins.
+func (fs *formSink) corsAllowed(origin string) bool {
+	if origin == "" || len(fs.cors) == 0 {
+		return false
+	}
+	if contains(fs.cors, anyOrigin) {
+		return true
+	}
+	normalized, err := parseOrigin(origin)
+	return err == nil && contains(fs.cors, normalized)
+}
+
+// allowCORS adds the headers letting the page that sent r read the
+// response, if its origin is allowed to.
+func (fs *formSink) allowCORS(w http.ResponseWriter, r *http.Request) {
+	if len(fs.cors) == 0 {
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); fs.corsAllowed(origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
+	}
+}
+
+// servePreflight answers an OPTIONS request for a form. Browsers send one
+// before submitting with fetch() from another site, and only go ahead if
+// the response allows it. Preflights from origins that aren't allowed get
+// no Access-Control-* headers at all.
+func (fs *formSink) servePreflight(w http.ResponseWriter, r *http.Request) {
+	methods := "OPTIONS, POST"
+	if fs.token != nil {
+		methods = "GET, " + methods
+	}
+	w.Header().Set("Allow", methods)
+
+	if r.Header.Get("Access-Control-Request-Method") != "" && fs.corsAllowed(r.Header.Get("Origin")) {
+		w.Header().Set("Access-Control-Allow-Methods", methods)
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+	}
+	writeStatus(w, http.StatusNoContent)
+}
@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendJSON submits values to the contact form, accepting JSON, and decodes
+// the response.
+func sendJSON(t *testing.T, sink http.Handler, values url.Values, headers map[string]string) (*http.Response, *submissionResponse) {
+	r := httptest.NewRequest(http.MethodPost, "/contact", strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept", "application/json, text/plain;q=0.9")
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	sink.ServeHTTP(w, r)
+
+	result := w.Result()
+	assert.Equal(t, "application/json", result.Header.Get("Content-Type"))
+	response := &submissionResponse{}
+	require.Nil(t, json.NewDecoder(result.Body).Decode(response))
+	return result, response
+}
+
+func TestWantsJSON(t *testing.T) {
+	accepts := map[string]bool{
+		"application/json":                    true,
+		"text/html, application/json;q=0.9":   true,
+		"Application/JSON":                    true,
+		"text/html,application/xhtml+xml,*/*": false,
+		"application/jsonp":                   false,
+		"":                                    false,
+	}
+	for accept, want := range accepts {
+		r := httptest.NewRequest(http.MethodPost, "/contact", nil)
+		r.Header.Set("Accept", accept)
+		assert.Equal(t, want, wantsJSON(r), accept)
+	}
+}
+
+func TestJSONResponse(t *testing.T) {
+	mock := &mockDepositor{}
+	form := *simpleForm
+	form.ErrorRedirect = "https://ddg.gg/oops"
+	form.Constraints = map[string]*Constraint{"email": {Type: "email"}}
+	sink, err := newSink(mock, Config{Redirect: location}, &form)
+	require.Nil(t, err)
+
+	result, response := sendJSON(t, sink, url.Values{"name": {"crasm"}}, nil)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "ok", response.Status)
+	assert.Equal(t, location, response.Redirect)
+	assert.NotEmpty(t, response.ID)
+	require.NotNil(t, mock.msg)
+	assert.Equal(t, response.ID, mock.msg.Headers.Get(submissionHeader))
+	assert.Equal(t, response.ID, mock.data.Request.ID)
+
+	_, again := sendJSON(t, sink, url.Values{"name": {"crasm"}}, nil)
+	assert.NotEqual(t, response.ID, again.ID)
+
+	mock.msg = nil
+	result, response = sendJSON(t, sink, url.Values{"name": {"crasm"}, "email": {"nope"}}, nil)
+	assert.Equal(t, http.StatusBadRequest, result.StatusCode)
+	assert.Equal(t, &submissionResponse{
+		Status: "error",
+		Error:  "Bad Request",
+		Errors: map[string]string{"email": "must be an email address"},
+	}, response)
+	assert.Nil(t, mock.msg)
+
+	form.MaxFieldSize = 2
+	sink, err = newSink(mock, Config{Redirect: location}, &form)
+	require.Nil(t, err)
+	result, response = sendJSON(t, sink, url.Values{"name": {"crasm"}}, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, result.StatusCode)
+	assert.Equal(t, &submissionResponse{
+		Status:   "error",
+		Redirect: "https://ddg.gg/oops",
+		Error:    "Request Entity Too Large",
+	}, response)
+}
+
+func TestCORS(t *testing.T) {
+	form := *simpleForm
+	form.Origins = []string{"https://example.com"}
+	sink, err := newSink(&mockDepositor{}, Config{
+		AllowedOrigins: []string{"https://app.example.net"},
+		CORSOrigins:    []string{"https://app.example.net", "https://evil.example.org"},
+		Token:          TokenConfig{Secret: []byte("secret")},
+	}, &form)
+	require.Nil(t, err)
+
+	preflight := func(origin string) *http.Response {
+		r := httptest.NewRequest(http.MethodOptions, "/contact", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "POST")
+		r.Header.Set("Access-Control-Request-Headers", "content-type, accept")
+		w := httptest.NewRecorder()
+		sink.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	result := preflight("https://app.example.net")
+	assert.Equal(t, http.StatusNoContent, result.StatusCode)
+	assert.Equal(t, "https://app.example.net", result.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, OPTIONS, POST", result.Header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "content-type, accept", result.Header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, corsMaxAge, result.Header.Get("Access-Control-Max-Age"))
+	assert.Equal(t, "Origin", result.Header.Get("Vary"))
+
+	result = preflight("https://other.example.org")
+	assert.Equal(t, http.StatusNoContent, result.StatusCode)
+	assert.Empty(t, result.Header.Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, result.Header.Get("Access-Control-Allow-Methods"))
+
+	values := url.Values{"name": {"crasm"}, TokenField: {NewToken([]byte("secret"), "contact", time.Now().Add(-time.Minute))}}
+	result, response := sendJSON(t, sink, values, map[string]string{"Origin": "https://app.example.net"})
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "ok", response.Status)
+	assert.Equal(t, "https://app.example.net", result.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Retry-After", result.Header.Get("Access-Control-Expose-Headers"))
+
+	result, response = sendJSON(t, sink, values, map[string]string{"Origin": "https://other.example.org"})
+	assert.Equal(t, http.StatusForbidden, result.StatusCode)
+	assert.Equal(t, "error", response.Status)
+	assert.Empty(t, result.Header.Get("Access-Control-Allow-Origin"))
+
+	// Pages that may read the responses may only submit forms from
+	// origins the form allows, even with "*".
+	for _, cors := range [][]string{{"https://evil.example.org"}, {"*"}} {
+		sink, err := newSink(&mockDepositor{}, Config{CORSOrigins: cors}, &form)
+		require.Nil(t, err)
+		result, response = sendJSON(t, sink, url.Values{"name": {"crasm"}}, map[string]string{"Origin": "https://evil.example.org"})
+		assert.Equal(t, http.StatusForbidden, result.StatusCode, "%v", cors)
+		assert.Equal(t, "error", response.Status)
+		assert.Equal(t, "https://evil.example.org", result.Header.Get("Access-Control-Allow-Origin"))
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/contact", nil)
+	r.Header.Set("Origin", "https://app.example.net")
+	w := httptest.NewRecorder()
+	sink.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://app.example.net", w.Header().Get("Access-Control-Allow-Origin"))
+
+	r = httptest.NewRequest(http.MethodOptions, "/nope", nil)
+	w = httptest.NewRecorder()
+	sink.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	// Requests for absolute URIs have no path, which isn't any form's.
+	r, err = http.ReadRequest(bufio.NewReader(strings.NewReader("OPTIONS http://example.com HTTP/1.1\r\nHost: example.com\r\n\r\n")))
+	require.Nil(t, err)
+	require.Empty(t, r.URL.Path)
+	w = httptest.NewRecorder()
+	sink.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
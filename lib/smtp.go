@@ -0,0 +1,215 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+
+	"github.com/jpoehls/gophermail"
+)
+
+const defaultSMTPTimeout = 30 * time.Second
+
+// SMTPConfig describes a relay that messages are delivered to instead of
+// being stored in a maildir.
+type SMTPConfig struct {
+	// Addr is the relay's host and port, e.g. "mail.example.com:587".
+	Addr string
+
+	// TLS is "starttls" (the default), "tls" for implicit TLS as on port
+	// 465, or "none".
+	TLS string
+
+	// TLSConfig is used for both STARTTLS and implicit TLS. Defaults to
+	// verifying the relay's certificate against its host name.
+	TLSConfig *tls.Config
+
+	// Auth is "plain" (the default) or "login". There is no
+	// authentication without a Username.
+	Auth     string
+	Username string
+	Password string
+
+	// Timeout limits the whole exchange with the relay, including
+	// connecting. Defaults to 30 seconds.
+	Timeout time.Duration
+}
+
+// smtpDepositor delivers messages to an SMTP relay. The envelope sender is
+// the message's From address, and the envelope recipients are its To, Cc
+// and Bcc addresses, as derived from the form.
+type smtpDepositor struct {
+	config SMTPConfig
+	host   string
+}
+
+func newSMTPDepositor(config SMTPConfig) (*smtpDepositor, error) {
+	host, _, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return nil, e("invalid SMTP address %q: %v", config.Addr, err)
+	}
+
+	switch config.TLS {
+	case "":
+		config.TLS = "starttls"
+	case "starttls", "tls", "none":
+	default:
+		return nil, e("unknown SMTP TLS mode %q", config.TLS)
+	}
+
+	switch config.Auth {
+	case "":
+		config.Auth = "plain"
+	case "plain", "login":
+	default:
+		return nil, e("unknown SMTP auth mechanism %q", config.Auth)
+	}
+
+	if config.TLSConfig == nil {
+		config.TLSConfig = &tls.Config{ServerName: host}
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultSMTPTimeout
+	}
+
+	return &smtpDepositor{config, host}, nil
+}
+
+func (s *smtpDepositor) Deposit(ctx context.Context, sub *Submission) error {
+	raw, err := sub.Message.Bytes()
+	if err != nil {
+		return err
+	}
+
+	return s.DepositRaw(ctx, sub.Message, raw)
+}
+
+func (s *smtpDepositor) DepositRaw(ctx context.Context, msg *gophermail.Message, raw []byte) error {
+	recipients := envelopeRecipients(ctx, msg)
+	if len(recipients) < 1 {
+		return gophermail.ErrMissingRecipient
+	}
+
+	deadline := time.Now().Add(s.config.Timeout)
+	dialer := &net.Dialer{Deadline: deadline}
+
+	var conn net.Conn
+	var err error
+	if s.config.TLS == "tls" {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: s.config.TLSConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", s.config.Addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", s.config.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if s.config.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return e("SMTP relay %q doesn't support STARTTLS", s.config.Addr)
+		}
+		if err := c.StartTLS(s.config.TLSConfig); err != nil {
+			return err
+		}
+	}
+
+	if s.config.Username != "" {
+		var auth smtp.Auth
+		if s.config.Auth == "login" {
+			auth = &loginAuth{s.config.Username, s.config.Password}
+		} else {
+			auth = smtp.PlainAuth("", s.config.Username, s.config.Password, s.host)
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(msg.From.Address); err != nil {
+		return deliveryError("", err)
+	}
+	for _, rcpt := range recipients {
+		if err := c.Rcpt(rcpt); err != nil {
+			return deliveryError(rcpt, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return deliveryError("", err)
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return deliveryError("", err)
+	}
+
+	return c.Quit()
+}
+
+type recipientsKey struct{}
+
+// withRecipients limits the delivery of a message to some of its
+// recipients, e.g. those left after a *PartialDeliveryError.
+func withRecipients(ctx context.Context, recipients []string) context.Context {
+	return context.WithValue(ctx, recipientsKey{}, recipients)
+}
+
+// envelopeRecipients lists the addresses of every recipient of msg, or of
+// those that ctx limits its delivery to.
+func envelopeRecipients(ctx context.Context, msg *gophermail.Message) []string {
+	if recipients, ok := ctx.Value(recipientsKey{}).([]string); ok {
+		return recipients
+	}
+	recipients := make([]string, 0, len(msg.To)+len(msg.Cc)+len(msg.Bcc))
+	for _, list := range [][]mail.Address{msg.To, msg.Cc, msg.Bcc} {
+		for _, a := range list {
+			recipients = append(recipients, a.Address)
+		}
+	}
+	return recipients
+}
+
+// loginAuth implements the non-standard but common AUTH LOGIN mechanism.
+// Like smtp.PlainAuth, it refuses to send credentials without TLS unless
+// the relay is on localhost.
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, e("refusing AUTH LOGIN without TLS")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch string(fromServer) {
+	case "Username:":
+		return []byte(a.username), nil
+	case "Password:":
+		return []byte(a.password), nil
+	}
+	return nil, e("unexpected AUTH LOGIN challenge %q", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,265 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMTP is an in-process stand-in for an SMTP relay that accepts a
+// single message per connection and records it.
+type fakeSMTP struct {
+	fakeServer
+	reject string // A recipient to refuse with 550
+
+	mu       sync.Mutex
+	tls      bool
+	username string
+	password string
+	from     string
+	rcpts    []string
+	data     string
+}
+
+func newFakeSMTP(t *testing.T, tlsConfig *tls.Config, implicit bool) *fakeSMTP {
+	s := &fakeSMTP{fakeServer: listenFake(t, "tcp", "127.0.0.1:0", tlsConfig, implicit)}
+	s.accept(s.serve)
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	secure := s.implicit
+	s.mu.Lock()
+	s.tls = secure
+	s.mu.Unlock()
+
+	text.PrintfLine("220 localhost fake ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := strings.TrimSpace(strings.TrimPrefix(line, line[:len(verb)]))
+
+		s.mu.Lock()
+		switch verb {
+		case "EHLO":
+			if s.tlsConfig != nil && !secure {
+				text.PrintfLine("250-localhost")
+				text.PrintfLine("250-STARTTLS")
+			} else {
+				text.PrintfLine("250-localhost")
+			}
+			text.PrintfLine("250 AUTH PLAIN LOGIN")
+
+		case "STARTTLS":
+			text.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				s.mu.Unlock()
+				return
+			}
+			conn = tlsConn
+			text = textproto.NewConn(conn)
+			secure = true
+			s.tls = true
+
+		case "AUTH":
+			fields := strings.Fields(arg)
+			if fields[0] == "PLAIN" {
+				decoded, _ := base64.StdEncoding.DecodeString(fields[1])
+				parts := strings.Split(string(decoded), "\x00")
+				s.username, s.password = parts[1], parts[2]
+			} else {
+				text.PrintfLine("334 VXNlcm5hbWU6") // Username:
+				user, _ := text.ReadLine()
+				text.PrintfLine("334 UGFzc3dvcmQ6") // Password:
+				pass, _ := text.ReadLine()
+				decodedUser, _ := base64.StdEncoding.DecodeString(user)
+				decodedPass, _ := base64.StdEncoding.DecodeString(pass)
+				s.username, s.password = string(decodedUser), string(decodedPass)
+			}
+			text.PrintfLine("235 Authenticated")
+
+		case "MAIL":
+			s.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			text.PrintfLine("250 OK")
+
+		case "RCPT":
+			rcpt := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if rcpt == s.reject {
+				text.PrintfLine("550 No such user")
+			} else {
+				s.rcpts = append(s.rcpts, rcpt)
+				text.PrintfLine("250 OK")
+			}
+
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			data, _ := ioutil.ReadAll(text.DotReader())
+			s.data = string(data)
+			text.PrintfLine("250 Queued")
+
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			s.mu.Unlock()
+			return
+
+		default:
+			text.PrintfLine("502 Not implemented")
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Makes a self-signed certificate for 127.0.0.1 and returns server and
+// client configurations trusting it.
+func testTLSConfig(t *testing.T) (server *tls.Config, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server = &tls.Config{Certificates: []tls.Certificate{tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}}}
+	client = &tls.Config{ServerName: "127.0.0.1", RootCAs: pool}
+	return server, client
+}
+
+func TestSMTP(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfig(t)
+
+	cases := []struct {
+		mode     string
+		implicit bool
+		auth     string
+	}{
+		{"starttls", false, "plain"},
+		{"starttls", false, "login"},
+		{"tls", true, "plain"},
+	}
+
+	for _, c := range cases {
+		server := newFakeSMTP(t, serverTLS, c.implicit)
+		defer server.Close()
+
+		relay, err := newSMTPDepositor(SMTPConfig{
+			Addr:      server.Addr(),
+			TLS:       c.mode,
+			TLSConfig: clientTLS,
+			Auth:      c.auth,
+			Username:  "crasm",
+			Password:  "hunter2",
+			Timeout:   5 * time.Second,
+		})
+		require.Nil(t, err)
+
+		msg := simpleMessage()
+		msg.Cc = []mail.Address{mail.Address{Address: "archive@vczf.io"}}
+		msg.Bcc = []mail.Address{mail.Address{Address: "audit@vczf.io"}}
+		require.Nil(t, depositMessage(relay, msg), c.mode+" "+c.auth)
+
+		server.mu.Lock()
+		assert.True(t, server.tls)
+		assert.Equal(t, "crasm", server.username)
+		assert.Equal(t, "hunter2", server.password)
+		assert.Equal(t, msg.From.Address, server.from)
+		assert.Equal(t, []string{msg.To[0].Address, "archive@vczf.io", "audit@vczf.io"}, server.rcpts)
+		assert.Contains(t, server.data, "Subject: contact request")
+		assert.NotContains(t, server.data, "audit@vczf.io")
+		server.mu.Unlock()
+	}
+}
+
+func TestSMTPErrors(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfig(t)
+
+	// No STARTTLS offered
+	plain := newFakeSMTP(t, nil, false)
+	defer plain.Close()
+	relay, err := newSMTPDepositor(SMTPConfig{Addr: plain.Addr(), TLSConfig: clientTLS})
+	require.Nil(t, err)
+	assert.NotNil(t, depositMessage(relay, simpleMessage()))
+
+	// Untrusted certificate
+	server := newFakeSMTP(t, serverTLS, false)
+	defer server.Close()
+	relay, err = newSMTPDepositor(SMTPConfig{Addr: server.Addr()})
+	require.Nil(t, err)
+	assert.NotNil(t, depositMessage(relay, simpleMessage()))
+
+	// Refused recipient
+	server.mu.Lock()
+	server.reject = simpleMessage().To[0].Address
+	server.mu.Unlock()
+	relay, err = newSMTPDepositor(SMTPConfig{Addr: server.Addr(), TLSConfig: clientTLS})
+	require.Nil(t, err)
+	assert.NotNil(t, depositMessage(relay, simpleMessage()))
+
+	// Nothing listening
+	relay, err = newSMTPDepositor(SMTPConfig{Addr: "127.0.0.1:1", TLS: "none", Timeout: time.Second})
+	require.Nil(t, err)
+	assert.NotNil(t, depositMessage(relay, simpleMessage()))
+
+	// Bad configuration
+	for _, config := range []SMTPConfig{
+		SMTPConfig{Addr: "localhost"},
+		SMTPConfig{Addr: "localhost:25", TLS: "ssl"},
+		SMTPConfig{Addr: "localhost:25", Auth: "cram-md5"},
+	} {
+		_, err := newSMTPDepositor(config)
+		assert.NotNil(t, err)
+	}
+}
+
+// Credentials are never sent in the clear to a remote relay.
+func TestLoginAuthRequiresTLS(t *testing.T) {
+	auth := &loginAuth{"crasm", "hunter2"}
+
+	_, _, err := auth.Start(&smtp.ServerInfo{Name: "mail.vczf.io"})
+	assert.NotNil(t, err)
+
+	mech, _, err := auth.Start(&smtp.ServerInfo{Name: "mail.vczf.io", TLS: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "LOGIN", mech)
+
+	_, _, err = auth.Start(&smtp.ServerInfo{Name: "localhost"})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,602 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jpoehls/gophermail"
+)
+
+const (
+	defaultSpoolMinBackoff = 30 * time.Second
+	defaultSpoolMaxBackoff = time.Hour
+	defaultSpoolMaxAge     = 72 * time.Hour
+)
+
+// The subdirectories of a spool: partially written entries, entries
+// waiting to be delivered, and entries that never were.
+const (
+	spoolTmp   = "tmp"
+	spoolQueue = "queue"
+	spoolDead  = "dead"
+)
+
+// SpoolConfig describes a directory where submissions are kept until
+// they're delivered, so that they survive failed deliveries and restarts.
+type SpoolConfig struct {
+	// With several targets in Config.Deliver, each is spooled in a
+	// directory of Dir of its own, named by spoolName.
+	Dir string
+
+	// After a failed delivery, the next one is attempted after MinBackoff,
+	// which doubles with each failure up to MaxBackoff. Default to 30
+	// seconds and an hour.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxAge is how long delivery is retried before the submission is
+	// moved to the dead-letter directory. Defaults to 72 hours.
+	MaxAge time.Duration
+}
+
+// spoolDepositor accepts submissions by writing them into a spool
+// directory, from which a background worker delivers them to next. Entries
+// are written atomically, so that the spool never holds a partial
+// submission, and are only removed once next accepts them.
+//
+// If next is a RawDepositor, messages that are already encoded, e.g. ones
+// encrypted by a pgpDepositor, can be spooled with DepositRaw. They're
+// stored as they are, along with only their envelope.
+type spoolDepositor struct {
+	config SpoolConfig
+	next   Depositor
+
+	wake chan struct{} // Signals new entries
+	stop chan struct{}
+	done chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]time.Time // Next attempt by entry ID
+}
+
+// spoolEntry is the JSON file a submission is spooled as.
+type spoolEntry struct {
+	Received    time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string `json:",omitempty"`
+
+	Message spoolMessage
+	Data    *spoolData `json:",omitempty"`
+	Raw     []byte     `json:",omitempty"` // The encoded message, for DepositRaw
+
+	// Recipients are those left to deliver to after a partial delivery,
+	// or nil for all of them.
+	Recipients []string `json:",omitempty"`
+}
+
+type spoolMessage struct {
+	From        mail.Address
+	ReplyTo     mail.Address
+	To          []mail.Address
+	Cc          []mail.Address
+	Bcc         []mail.Address
+	Subject     string
+	Body        string
+	HTMLBody    string
+	Attachments []spoolAttachment
+	Headers     mail.Header
+}
+
+type spoolAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+type spoolData struct {
+	Form    *Form
+	Fields  []TemplateField
+	Files   []spoolFile
+	Request TemplateRequest
+}
+
+type spoolFile struct {
+	TemplateFile
+	Data []byte
+}
+
+// newSpoolDepositor opens the spool, creating it if needed, and starts
+// delivering whatever it already holds.
+func newSpoolDepositor(config SpoolConfig, next Depositor) (*spoolDepositor, error) {
+	if config.Dir == "" {
+		return nil, e("missing spool directory")
+	}
+	if config.MinBackoff == 0 {
+		config.MinBackoff = defaultSpoolMinBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = defaultSpoolMaxBackoff
+	}
+	if config.MaxAge == 0 {
+		config.MaxAge = defaultSpoolMaxAge
+	}
+
+	for _, sub := range []string{spoolTmp, spoolQueue, spoolDead} {
+		if err := os.MkdirAll(filepath.Join(config.Dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &spoolDepositor{
+		config:  config,
+		next:    next,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: map[string]time.Time{},
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// load reads the queue left by a previous run. Entries that were being
+// written are discarded, since they were never accepted, and unreadable
+// ones are moved to the dead-letter directory.
+func (s *spoolDepositor) load() error {
+	tmp, err := ioutil.ReadDir(s.path(spoolTmp, ""))
+	if err != nil {
+		return err
+	}
+	for _, info := range tmp {
+		os.Remove(filepath.Join(s.path(spoolTmp, ""), info.Name()))
+	}
+
+	queue, err := ioutil.ReadDir(s.path(spoolQueue, ""))
+	if err != nil {
+		return err
+	}
+	for _, info := range queue {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(info.Name(), ".json")
+		entry, err := s.read(id)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"id":    id,
+				"error": err.Error(),
+			}).Error("Unreadable spool entry")
+			os.Rename(s.path(spoolQueue, id), s.path(spoolDead, id))
+			continue
+		}
+		s.pending[id] = entry.NextAttempt
+	}
+
+	if len(s.pending) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"count": len(s.pending),
+		}).Info("Resuming delivery of spooled submissions")
+	}
+	return nil
+}
+
+// Close stops delivering, leaving undelivered submissions in the spool.
+func (s *spoolDepositor) Close() error {
+	close(s.stop)
+	<-s.done
+	return nil
+}
+
+// Deposit only writes the submission into the spool, so ctx doesn't affect
+// its delivery.
+func (s *spoolDepositor) Deposit(ctx context.Context, sub *Submission) error {
+	entry, err := newSpoolEntry(sub.Message, sub.Data)
+	if err != nil {
+		return err
+	}
+	return s.enqueue(entry)
+}
+
+// DepositRaw spools raw as it is, keeping only the envelope of msg: its
+// addresses and formsink's headers, not the subject or any of what was
+// submitted.
+func (s *spoolDepositor) DepositRaw(ctx context.Context, msg *gophermail.Message, raw []byte) error {
+	if _, ok := s.next.(RawDepositor); !ok {
+		return e("can't spool encoded messages for %T", s.next)
+	}
+
+	now := time.Now()
+	return s.enqueue(&spoolEntry{
+		Received:    now,
+		NextAttempt: now,
+		Message: spoolMessage{
+			From:    msg.From,
+			To:      msg.To,
+			Cc:      msg.Cc,
+			Bcc:     msg.Bcc,
+			Headers: msg.Headers,
+		},
+		Raw: raw,
+	})
+}
+
+// enqueue writes a new entry into the queue and wakes the worker.
+func (s *spoolDepositor) enqueue(entry *spoolEntry) error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	if err := s.write(spoolQueue, id, entry); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.pending[id] = entry.NextAttempt
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default: // Already signaled
+	}
+	return nil
+}
+
+// run delivers entries as they become due until Close.
+func (s *spoolDepositor) run() {
+	defer close(s.done)
+	for {
+		timer := time.NewTimer(s.deliverDue())
+		select {
+		case <-s.wake:
+		case <-timer.C:
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// deliverDue attempts every entry that is due, oldest first, and returns
+// how long until the next one is.
+func (s *spoolDepositor) deliverDue() time.Duration {
+	now := time.Now()
+	s.mu.Lock()
+	due := []string{}
+	for id, next := range s.pending {
+		if !next.After(now) {
+			due = append(due, id)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(due) // IDs start with the time they were received
+
+	for _, id := range due {
+		select {
+		case <-s.stop:
+			return 0
+		default:
+		}
+		s.attempt(id)
+	}
+
+	wait := s.config.MaxBackoff
+	now = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, next := range s.pending {
+		if until := next.Sub(now); until < wait {
+			wait = until
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// attempt delivers one entry, removing it from the queue unless it fails
+// temporarily and is young enough to be tried again later. Entries that
+// are refused for good go to the dead-letter directory right away.
+func (s *spoolDepositor) attempt(id string) {
+	log := logrus.WithFields(logrus.Fields{"id": id})
+
+	entry, err := s.read(id)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unreadable spool entry")
+		s.retire(id, spoolDead, nil)
+		return
+	}
+
+	err = s.deliver(entry)
+	if err == nil {
+		log.Info("Delivered spooled submission")
+		s.retire(id, "", nil)
+		return
+	}
+
+	now := time.Now()
+	entry.Attempts++
+	entry.LastError = err.Error()
+	log = log.WithFields(logrus.Fields{
+		"attempts": entry.Attempts,
+		"error":    err.Error(),
+	})
+
+	var partial *PartialDeliveryError
+	if errors.As(err, &partial) {
+		entry.Recipients = partial.Recipients()
+		log = log.WithFields(logrus.Fields{"recipients": entry.Recipients})
+	}
+
+	if isPermanent(err) {
+		log.Error("Spooled submission was refused")
+		s.retire(id, spoolDead, entry)
+		return
+	}
+	if now.Sub(entry.Received) >= s.config.MaxAge {
+		log.Error("Giving up on spooled submission")
+		s.retire(id, spoolDead, entry)
+		return
+	}
+
+	entry.NextAttempt = now.Add(s.backoff(entry.Attempts))
+	if err := s.write(spoolQueue, id, entry); err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Couldn't update spool entry")
+	}
+	log.WithFields(logrus.Fields{
+		"next": entry.NextAttempt,
+	}).Warn("Delivery of spooled submission failed")
+
+	s.mu.Lock()
+	s.pending[id] = entry.NextAttempt
+	s.mu.Unlock()
+}
+
+// retire takes an entry out of the queue, moving it into dir unless that's
+// "", and writing entry over it if it's not nil.
+func (s *spoolDepositor) retire(id, dir string, entry *spoolEntry) {
+	s.mu.Lock()
+	delete(s.pending, id)
+	s.mu.Unlock()
+
+	var err error
+	switch {
+	case dir == "":
+		err = os.Remove(s.path(spoolQueue, id))
+	case entry != nil:
+		if err = s.write(dir, id, entry); err == nil {
+			err = os.Remove(s.path(spoolQueue, id))
+		}
+	default:
+		err = os.Rename(s.path(spoolQueue, id), s.path(dir, id))
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"id":    id,
+			"error": err.Error(),
+		}).Error("Couldn't remove spool entry")
+	}
+}
+
+// backoff is the wait before the next attempt after the given number of
+// failed ones.
+func (s *spoolDepositor) backoff(attempts int) time.Duration {
+	wait := s.config.MinBackoff
+	for i := 1; i < attempts && wait < s.config.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > s.config.MaxBackoff {
+		wait = s.config.MaxBackoff
+	}
+	return wait
+}
+
+// path returns the file of an entry in one of the subdirectories, or the
+// subdirectory itself if id is "".
+func (s *spoolDepositor) path(dir, id string) string {
+	if id == "" {
+		return filepath.Join(s.config.Dir, dir)
+	}
+	return filepath.Join(s.config.Dir, dir, id+".json")
+}
+
+func (s *spoolDepositor) read(id string) (*spoolEntry, error) {
+	raw, err := ioutil.ReadFile(s.path(spoolQueue, id))
+	if err != nil {
+		return nil, err
+	}
+	entry := &spoolEntry{}
+	if err := json.Unmarshal(raw, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// write stores an entry atomically: it's written and synced into tmp
+// before being renamed into place.
+func (s *spoolDepositor) write(dir, id string, entry *spoolEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(s.path(spoolTmp, ""), id)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(raw); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path(dir, id))
+}
+
+// spoolName is the directory of a target of Config.Deliver inside of a
+// spool shared by several: its name, or for a URL, which may hold secrets
+// and characters that can't be in file names, its scheme and a hash of it.
+func spoolName(target string) string {
+	colon := strings.Index(target, ":")
+	if colon < 0 {
+		return target
+	}
+	sum := sha256.Sum256([]byte(target))
+	return target[:colon] + "-" + hex.EncodeToString(sum[:6])
+}
+
+// newID returns a unique ID that sorts by the time it was made.
+func newID() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102T150405.000000000") + "-" + hex.EncodeToString(random), nil
+}
+
+// newSpoolEntry reads the attachments and files of a submission into an
+// entry that is due immediately.
+func newSpoolEntry(msg *gophermail.Message, data *TemplateData) (*spoolEntry, error) {
+	now := time.Now()
+	entry := &spoolEntry{
+		Received:    now,
+		NextAttempt: now,
+		Message: spoolMessage{
+			From:        msg.From,
+			ReplyTo:     msg.ReplyTo,
+			To:          msg.To,
+			Cc:          msg.Cc,
+			Bcc:         msg.Bcc,
+			Subject:     msg.Subject,
+			Body:        msg.Body,
+			HTMLBody:    msg.HTMLBody,
+			Attachments: make([]spoolAttachment, 0, len(msg.Attachments)),
+			Headers:     msg.Headers,
+		},
+	}
+
+	for _, a := range msg.Attachments {
+		contents, err := ioutil.ReadAll(a.Data)
+		if err != nil {
+			return nil, err
+		}
+		entry.Message.Attachments = append(entry.Message.Attachments,
+			spoolAttachment{a.Name, a.ContentType, contents})
+	}
+
+	if data == nil {
+		return entry, nil
+	}
+
+	entry.Data = &spoolData{
+		Form:    data.Form,
+		Fields:  data.Fields,
+		Files:   make([]spoolFile, 0, len(data.Files)),
+		Request: data.Request,
+	}
+	for _, f := range data.Files {
+		contents, err := readFile(f)
+		if err != nil {
+			return nil, err
+		}
+		entry.Data.Files = append(entry.Data.Files, spoolFile{f, contents})
+	}
+	return entry, nil
+}
+
+// deliver passes an entry on to next, the way it was spooled.
+func (s *spoolDepositor) deliver(entry *spoolEntry) error {
+	ctx := context.Background()
+	if entry.Recipients != nil {
+		ctx = withRecipients(ctx, entry.Recipients)
+	}
+
+	msg, data := entry.restore()
+	if entry.Raw == nil {
+		return s.next.Deposit(ctx, &Submission{msg, data})
+	}
+
+	// The entry may have been spooled for another target before a restart.
+	raw, ok := s.next.(RawDepositor)
+	if !ok {
+		return permanentError{e("can't deliver encoded messages to %T", s.next)}
+	}
+	return raw.DepositRaw(ctx, msg, entry.Raw)
+}
+
+// restore rebuilds the submission an entry was made from.
+func (entry *spoolEntry) restore() (*gophermail.Message, *TemplateData) {
+	m := entry.Message
+	msg := &gophermail.Message{
+		From:        m.From,
+		ReplyTo:     m.ReplyTo,
+		To:          m.To,
+		Cc:          m.Cc,
+		Bcc:         m.Bcc,
+		Subject:     m.Subject,
+		Body:        m.Body,
+		HTMLBody:    m.HTMLBody,
+		Attachments: make([]gophermail.Attachment, 0, len(m.Attachments)),
+		Headers:     m.Headers,
+	}
+	for _, a := range m.Attachments {
+		msg.Attachments = append(msg.Attachments, gophermail.Attachment{
+			Name:        a.Name,
+			ContentType: a.ContentType,
+			Data:        bytes.NewReader(a.Data),
+		})
+	}
+
+	if entry.Data == nil {
+		return msg, nil
+	}
+
+	data := &TemplateData{
+		Form:    entry.Data.Form,
+		Fields:  entry.Data.Fields,
+		Files:   make([]TemplateFile, 0, len(entry.Data.Files)),
+		Request: entry.Data.Request,
+	}
+	for _, f := range entry.Data.Files {
+		file := f.TemplateFile
+		contents := f.Data
+		file.contents = func() ([]byte, error) {
+			return contents, nil
+		}
+		data.Files = append(data.Files, file)
+	}
+	return msg, data
+}
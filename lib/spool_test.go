@@ -0,0 +1,414 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jpoehls/gophermail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyDepositor fails a number of times before accepting submissions,
+// with refusal if it's set or else a temporary reply.
+type flakyDepositor struct {
+	mu        sync.Mutex
+	failures  int
+	refusal   error
+	attempts  int
+	envelopes [][]string // Recipients of each attempt
+	delivered []*gophermail.Message
+	data      []*TemplateData
+	raw       [][]byte
+}
+
+func (f *flakyDepositor) Deposit(ctx context.Context, s *Submission) error {
+	return f.accept(ctx, s.Message, s.Data, nil)
+}
+
+func (f *flakyDepositor) DepositRaw(ctx context.Context, msg *gophermail.Message, raw []byte) error {
+	return f.accept(ctx, msg, nil, raw)
+}
+
+func (f *flakyDepositor) accept(ctx context.Context, msg *gophermail.Message, data *TemplateData, raw []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts++
+	f.envelopes = append(f.envelopes, envelopeRecipients(ctx, msg))
+	if f.failures != 0 {
+		f.failures--
+		if f.refusal != nil {
+			return f.refusal
+		}
+		return &DeliveryError{Code: 451, Message: "Try again"}
+	}
+	f.delivered = append(f.delivered, msg)
+	f.data = append(f.data, data)
+	f.raw = append(f.raw, raw)
+	return nil
+}
+
+func (f *flakyDepositor) count() (attempts, delivered int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.attempts, len(f.delivered)
+}
+
+// Waits up to five seconds for condition to hold.
+func eventually(t *testing.T, condition func() bool, message string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "timed out waiting", message)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func spoolFiles(t *testing.T, dir, sub string) []os.FileInfo {
+	files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+	require.Nil(t, err)
+	return files
+}
+
+// Submissions are accepted once spooled, and retried until delivered.
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	next := &flakyDepositor{failures: 2}
+	spool, err := newSpoolDepositor(SpoolConfig{
+		Dir:        dir,
+		MinBackoff: 10 * time.Millisecond,
+	}, next)
+	require.Nil(t, err)
+	defer spool.Close()
+
+	sink, err := newSink(spool, Config{Redirect: location}, simpleForm)
+	require.Nil(t, err)
+	result := post(t, sink)
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+
+	eventually(t, func() bool {
+		_, delivered := next.count()
+		return delivered == 1
+	}, "delivery")
+	attempts, _ := next.count()
+	assert.Equal(t, 3, attempts)
+
+	next.mu.Lock()
+	checkMessage(t, next.delivered[0])
+	data := next.data[0]
+	next.mu.Unlock()
+	require.NotNil(t, data)
+	assert.Equal(t, "crasm", data.Value("name"))
+	require.Len(t, data.Files, 1)
+	contents, err := readFile(data.Files[0])
+	require.Nil(t, err)
+	assert.Len(t, contents, 53)
+
+	eventually(t, func() bool {
+		return len(spoolFiles(t, dir, spoolQueue)) == 0
+	}, "removal from the queue")
+	assert.Empty(t, spoolFiles(t, dir, spoolTmp))
+	assert.Empty(t, spoolFiles(t, dir, spoolDead))
+}
+
+// What's left in the spool is delivered after a restart, while partially
+// written entries are discarded.
+func TestSpoolResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	down := &flakyDepositor{failures: -1}
+	spool, err := newSpoolDepositor(SpoolConfig{Dir: dir, MinBackoff: time.Hour}, down)
+	require.Nil(t, err)
+	require.Nil(t, depositMessage(spool, formMessage("contact")))
+	require.Nil(t, depositMessage(spool, formMessage("survey")))
+	eventually(t, func() bool {
+		attempts, _ := down.count()
+		return attempts == 2
+	}, "first attempts")
+	require.Nil(t, spool.Close())
+
+	assert.Len(t, spoolFiles(t, dir, spoolQueue), 2)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, spoolTmp, "partial"), []byte("{"), 0600))
+
+	// Not due for an hour, so pretend it's been that long.
+	s := &spoolDepositor{config: SpoolConfig{Dir: dir}}
+	for _, info := range spoolFiles(t, dir, spoolQueue) {
+		id := strings.TrimSuffix(info.Name(), ".json")
+		entry, err := s.read(id)
+		require.Nil(t, err)
+		assert.Equal(t, 1, entry.Attempts)
+		assert.NotEmpty(t, entry.LastError)
+		entry.NextAttempt = time.Now()
+		require.Nil(t, s.write(spoolQueue, id, entry))
+	}
+
+	up := &flakyDepositor{}
+	spool, err = newSpoolDepositor(SpoolConfig{Dir: dir}, up)
+	require.Nil(t, err)
+	defer spool.Close()
+
+	eventually(t, func() bool {
+		_, delivered := up.count()
+		return delivered == 2
+	}, "delivery after restart")
+	up.mu.Lock()
+	assert.Equal(t, "contact", up.delivered[0].Headers.Get(formHeader))
+	assert.Equal(t, "survey", up.delivered[1].Headers.Get(formHeader))
+	up.mu.Unlock()
+	assert.Empty(t, spoolFiles(t, dir, spoolTmp))
+}
+
+// Submissions that can't be delivered in time end up in the dead-letter
+// directory, as do unreadable ones.
+func TestSpoolDead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, spoolQueue), 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, spoolQueue, "garbage.json"), []byte("{"), 0600))
+
+	down := &flakyDepositor{failures: -1}
+	spool, err := newSpoolDepositor(SpoolConfig{
+		Dir:        dir,
+		MinBackoff: time.Millisecond,
+		MaxAge:     20 * time.Millisecond,
+	}, down)
+	require.Nil(t, err)
+	defer spool.Close()
+
+	require.Nil(t, depositMessage(spool, formMessage("contact")))
+	eventually(t, func() bool {
+		return len(spoolFiles(t, dir, spoolDead)) == 2
+	}, "dead letters")
+	assert.Empty(t, spoolFiles(t, dir, spoolQueue))
+
+	attempts, delivered := down.count()
+	assert.True(t, attempts > 1)
+	assert.Equal(t, 0, delivered)
+}
+
+// Submissions that are refused for good aren't retried.
+func TestSpoolRefused(t *testing.T) {
+	refusals := []error{
+		&DeliveryError{Code: 550, Message: "No such user"},
+		&WebhookError{StatusCode: http.StatusForbidden},
+		permanentError{e("can't deliver encoded messages")},
+	}
+	for _, refusal := range refusals {
+		dir, err := ioutil.TempDir("", "formsink")
+		require.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		refusing := &flakyDepositor{failures: -1, refusal: refusal}
+		spool, err := newSpoolDepositor(SpoolConfig{Dir: dir, MinBackoff: time.Millisecond}, refusing)
+		require.Nil(t, err)
+
+		require.Nil(t, depositMessage(spool, formMessage("contact")))
+		eventually(t, func() bool {
+			return len(spoolFiles(t, dir, spoolDead)) == 1
+		}, "dead letter")
+		require.Nil(t, spool.Close())
+
+		assert.Empty(t, spoolFiles(t, dir, spoolQueue), refusal.Error())
+		attempts, _ := refusing.count()
+		assert.Equal(t, 1, attempts, refusal.Error())
+	}
+}
+
+// After a partial delivery, only the recipients that failed get the
+// submission again.
+func TestSpoolPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	msg := formMessage("contact")
+	all := envelopeRecipients(context.Background(), msg)
+	require.Len(t, all, 3)
+	next := &flakyDepositor{failures: 1, refusal: &PartialDeliveryError{DeliveryErrors{
+		{Recipient: all[1], Code: 452, Message: "Mailbox is full"},
+	}}}
+	spool, err := newSpoolDepositor(SpoolConfig{Dir: dir, MinBackoff: 10 * time.Millisecond}, next)
+	require.Nil(t, err)
+	defer spool.Close()
+
+	require.Nil(t, depositMessage(spool, msg))
+	eventually(t, func() bool {
+		_, delivered := next.count()
+		return delivered == 1
+	}, "delivery")
+
+	next.mu.Lock()
+	assert.Equal(t, [][]string{all, {all[1]}}, next.envelopes)
+	next.mu.Unlock()
+}
+
+func TestIsPermanent(t *testing.T) {
+	cases := []struct {
+		err       error
+		permanent bool
+	}{
+		{&DeliveryError{Code: 550}, true},
+		{DeliveryErrors{{Code: 550}, {Code: 452}}, true},
+		{&DeliveryError{Code: 452}, false},
+		{&TargetError{"smtp", &DeliveryError{Code: 554}}, true},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, false},
+		{&url.Error{Op: "Post", Err: errors.New("EOF")}, false},
+		{e("disk full"), false},
+		{permanentError{e("can't deliver encoded messages")}, true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.permanent, isPermanent(c.err), c.err.Error())
+	}
+}
+
+func TestSpoolBackoff(t *testing.T) {
+	s := &spoolDepositor{config: SpoolConfig{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+	for attempts, wait := range map[int]time.Duration{
+		1:   time.Second,
+		2:   2 * time.Second,
+		4:   8 * time.Second,
+		5:   10 * time.Second,
+		100: 10 * time.Second,
+	} {
+		assert.Equal(t, wait, s.backoff(attempts), attempts)
+	}
+}
+
+// flakyTarget is the depositor for "flaky:" URLs.
+var flakyTarget *flakyDepositor
+
+func registerFlaky(f *flakyDepositor) {
+	flakyTarget = f
+	if !contains(DepositorSchemes(), "flaky") {
+		RegisterDepositor("flaky", func(u *url.URL) (Depositor, error) {
+			return flakyTarget, nil
+		})
+	}
+}
+
+// Each target has a spool of its own, so that one failing doesn't get the
+// others more copies when it's retried.
+func TestSpoolTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	registerFlaky(&flakyDepositor{failures: 3})
+
+	config := Config{
+		Redirect: location,
+		Maildir:  filepath.Join(dir, "Maildir"),
+		Deliver:  []string{"maildir", "flaky:"},
+		Spool:    SpoolConfig{Dir: filepath.Join(dir, "spool"), MinBackoff: 10 * time.Millisecond},
+	}
+	d, err := newConfigDepositor(config)
+	require.Nil(t, err)
+	for _, target := range d.(*fanoutDepositor).targets {
+		defer target.depositor.(*spoolDepositor).Close()
+	}
+
+	sink, err := newSink(d, config, simpleForm)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusSeeOther, post(t, sink).StatusCode)
+
+	eventually(t, func() bool {
+		_, delivered := flakyTarget.count()
+		return delivered == 1
+	}, "delivery to the flaky target")
+	attempts, _ := flakyTarget.count()
+	assert.Equal(t, 4, attempts)
+
+	delivered, err := ioutil.ReadDir(filepath.Join(config.Maildir, "new"))
+	require.Nil(t, err)
+	assert.Len(t, delivered, 1, "the maildir only gets one copy")
+
+	assert.Empty(t, spoolFiles(t, filepath.Join(config.Spool.Dir, "maildir"), spoolQueue))
+	assert.Empty(t, spoolFiles(t, filepath.Join(config.Spool.Dir, spoolName("flaky:")), spoolQueue))
+}
+
+// Submissions are encrypted before they're spooled, so the spool only
+// holds their envelope in plaintext.
+func TestSpoolEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	_, key := testKey(t, dir)
+
+	registerFlaky(&flakyDepositor{failures: 1})
+	spoolDir := filepath.Join(dir, "spool")
+	d, err := newTargetDepositor(Config{
+		PGPKeys: []string{key},
+		Spool:   SpoolConfig{Dir: spoolDir, MinBackoff: time.Hour},
+	}, "flaky:")
+	require.Nil(t, err)
+	spool := d.(*pgpDepositor).next.(*spoolDepositor)
+
+	sink, err := newSink(d, Config{Redirect: location}, simpleForm)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusSeeOther, post(t, sink).StatusCode)
+	eventually(t, func() bool {
+		attempts, _ := flakyTarget.count()
+		return attempts == 1
+	}, "first attempt")
+	require.Nil(t, spool.Close())
+
+	queue := spoolFiles(t, spoolDir, spoolQueue)
+	require.Len(t, queue, 1)
+	contents, err := ioutil.ReadFile(filepath.Join(spoolDir, spoolQueue, queue[0].Name()))
+	require.Nil(t, err)
+	assert.NotContains(t, string(contents), "formsink!")
+
+	id := strings.TrimSuffix(queue[0].Name(), ".json")
+	entry, err := spool.read(id)
+	require.Nil(t, err)
+	assert.Contains(t, string(entry.Raw), "multipart/encrypted")
+	assert.Nil(t, entry.Data)
+	assert.Empty(t, entry.Message.Subject)
+	assert.Equal(t, "contact", entry.Message.Headers.Get(formHeader))
+
+	// Not due for an hour, so pretend it's been that long.
+	entry.NextAttempt = time.Now()
+	require.Nil(t, spool.write(spoolQueue, id, entry))
+	spool, err = newSpoolDepositor(SpoolConfig{Dir: spoolDir}, flakyTarget)
+	require.Nil(t, err)
+	defer spool.Close()
+
+	eventually(t, func() bool {
+		_, delivered := flakyTarget.count()
+		return delivered == 1
+	}, "delivery after restart")
+	flakyTarget.mu.Lock()
+	assert.Equal(t, entry.Raw, flakyTarget.raw[0])
+	flakyTarget.mu.Unlock()
+}
+
+func TestSpoolEncryptedUnsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	spool, err := newSpoolDepositor(SpoolConfig{Dir: dir}, &mockDepositor{})
+	require.Nil(t, err)
+	defer spool.Close()
+	assert.NotNil(t, spool.DepositRaw(context.Background(), formMessage("contact"), []byte("raw")))
+	assert.Empty(t, spoolFiles(t, dir, spoolQueue))
+}
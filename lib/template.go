@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/jpoehls/gophermail"
+)
+
+// The names of the templates that make up a message template. Each is
+// optional, but a message template must define at least one of them.
+const (
+	subjectTemplate = "subject"
+	textTemplate    = "text"
+	htmlTemplate    = "html"
+)
+
+// TemplateData is what a message template is executed with.
+type TemplateData struct {
+	Form    *Form
+	Fields  []TemplateField // In document order
+	Files   []TemplateFile
+	Request TemplateRequest
+}
+
+// Value returns the first value of the named field, or "" if there is no
+// such field, e.g. {{.Value "email"}}.
+func (d *TemplateData) Value(name string) string {
+	for _, f := range d.Fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// TemplateField is a submitted field.
+type TemplateField struct {
+	Name   string
+	Label  string
+	Legend string
+	Value  string   // The first of Values
+	Values []string // More than one only for multi-valued fields
+}
+
+// TemplateFile is an uploaded file, which is also attached to the message.
+type TemplateFile struct {
+	Name        string // Of the field it was uploaded with
+	Label       string
+	Filename    string
+	ContentType string
+	Size        int64
+
+	contents func() ([]byte, error) // Reads the file, see readFile
+}
+
+// TemplateRequest describes the HTTP request the form was submitted with.
+type TemplateRequest struct {
+	ID         string // Of the submission, as in the JSON response to it
+	RemoteAddr string
+	UserAgent  string
+	Referer    string
+	Time       time.Time
+}
+
+// messageTemplate renders the subject, plain-text body and HTML body of a
+// message. The subject and plain-text body use text/template, while the
+// HTML body uses html/template so that submitted values are escaped.
+type messageTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// loadTemplate parses a file defining "subject", "text" and/or "html"
+// templates, e.g.
+//
+//	{{define "subject"}}Message from {{.Value "name"}}{{end}}
+//	{{define "text"}}{{range .Fields}}{{.Label}}: {{.Value}}
+//	{{end}}{{end}}
+func loadTemplate(filename string) (*messageTemplate, error) {
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := texttemplate.New(filename).Parse(string(source))
+	if err != nil {
+		return nil, err
+	}
+
+	html, err := htmltemplate.New(filename).Parse(string(source))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &messageTemplate{text, html}
+	if t.text.Lookup(subjectTemplate) == nil &&
+		t.text.Lookup(textTemplate) == nil &&
+		t.html.Lookup(htmlTemplate) == nil {
+		return nil, e("template %q defines none of %q, %q or %q",
+			filename, subjectTemplate, textTemplate, htmlTemplate)
+	}
+
+	return t, nil
+}
+
+// render replaces the parts of msg that the template defines.
+func (t *messageTemplate) render(msg *gophermail.Message, data *TemplateData) error {
+	if t.text.Lookup(subjectTemplate) != nil {
+		subject := &bytes.Buffer{}
+		if err := t.text.ExecuteTemplate(subject, subjectTemplate, data); err != nil {
+			return err
+		}
+		// Headers can't span lines.
+		msg.Subject = strings.Join(strings.Fields(subject.String()), " ")
+	}
+
+	if t.text.Lookup(textTemplate) != nil {
+		body := &bytes.Buffer{}
+		if err := t.text.ExecuteTemplate(body, textTemplate, data); err != nil {
+			return err
+		}
+		msg.Body = body.String()
+	}
+
+	if t.html.Lookup(htmlTemplate) != nil {
+		body := &bytes.Buffer{}
+		if err := t.html.ExecuteTemplate(body, htmlTemplate, data); err != nil {
+			return err
+		}
+		msg.HTMLBody = body.String()
+	}
+
+	return nil
+}
+
+func newTemplateData(formSpec *Form, multipartForm *multipart.Form, r *http.Request) *TemplateData {
+	data := &TemplateData{
+		Form:   formSpec,
+		Fields: make([]TemplateField, 0, len(formSpec.Fields)),
+		Files:  make([]TemplateFile, 0),
+		Request: TemplateRequest{
+			RemoteAddr: r.RemoteAddr,
+			UserAgent:  r.UserAgent(),
+			Referer:    r.Referer(),
+			Time:       time.Now(),
+		},
+	}
+
+	for _, id := range formSpec.Fields {
+		values := fieldValues(formSpec, multipartForm, id)
+		data.Fields = append(data.Fields, TemplateField{
+			Name:   id,
+			Label:  formSpec.label(id),
+			Legend: formSpec.Legends[id],
+			Value:  values[0],
+			Values: values,
+		})
+	}
+
+	for _, id := range formSpec.Files {
+		for _, meta := range fileHeaders(formSpec, multipartForm, id) {
+			data.Files = append(data.Files, TemplateFile{
+				Name:        id,
+				Label:       formSpec.label(id),
+				Filename:    meta.Filename,
+				ContentType: meta.Header.Get("Content-Type"),
+				Size:        meta.Size,
+				contents:    fileContents(meta),
+			})
+		}
+	}
+
+	return data
+}
+
+// readFile reads the contents of an uploaded file.
+func readFile(f TemplateFile) ([]byte, error) {
+	if f.contents == nil {
+		return nil, e("contents of %q are unavailable", f.Filename)
+	}
+	return f.contents()
+}
+
+// fileContents returns a function reading an uploaded file.
+func fileContents(meta *multipart.FileHeader) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		file, err := meta.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return ioutil.ReadAll(file)
+	}
+}
@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplate(t *testing.T) {
+	mockDepositor := &mockDepositor{}
+
+	form := *simpleForm
+	form.Template = "../resources/contact.tmpl"
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, &form)
+	require.Nil(t, err)
+
+	result := post(t, sink)
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+
+	msg := mockDepositor.msg
+	require.NotNil(t, msg)
+	assert.Equal(t, "Contact request from crasm", msg.Subject)
+	assert.Equal(t, `crasm <crasm@formsink.email.vczf.io> wrote:
+
+I &#9829; formsink!
+
+Attached: tiny.ppm (image/x-portable-pixmap, 53 bytes)
+`, msg.Body)
+	assert.Equal(t, `<p><a href="mailto:crasm@formsink.email.vczf.io">crasm</a> wrote:</p>
+<blockquote>I &amp;#9829; formsink!</blockquote>`, msg.HTMLBody)
+	assert.Len(t, msg.Attachments, 1)
+}
+
+// A page's template is found next to it, wherever formsink is run from.
+func TestTemplateRelative(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	html, err := ioutil.ReadFile("../resources/contact.html")
+	require.Nil(t, err)
+	html = bytes.Replace(html, []byte("<form "), []byte("<form data-formsink-template='contact.tmpl' "), 1)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "contact.html"), html, 0600))
+	source, err := ioutil.ReadFile("../resources/contact.tmpl")
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "contact.tmpl"), source, 0600))
+
+	page, err := os.Open(filepath.Join(dir, "contact.html"))
+	require.Nil(t, err)
+	defer page.Close()
+
+	mockDepositor := &mockDepositor{}
+	sink, err := newSinkFromReader(mockDepositor, Config{Redirect: location}, page)
+	require.Nil(t, err)
+
+	assert.Equal(t, http.StatusSeeOther, post(t, sink).StatusCode)
+	require.NotNil(t, mockDepositor.msg)
+	assert.Equal(t, "Contact request from crasm", mockDepositor.msg.Subject)
+}
+
+// Only the parts the template defines are replaced.
+func TestTemplatePartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "subject.tmpl")
+	err = ioutil.WriteFile(filename, []byte(`{{define "subject"}}
+		{{.Form.Name}} from
+		{{.Value "email"}}
+	{{end}}`), 0600)
+	require.Nil(t, err)
+
+	mockDepositor := &mockDepositor{}
+	form := *simpleForm
+	form.Template = filename
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, &form)
+	require.Nil(t, err)
+
+	result := post(t, sink)
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+
+	msg := mockDepositor.msg
+	require.NotNil(t, msg)
+	assert.Equal(t, "contact from crasm@formsink.email.vczf.io", msg.Subject)
+	assert.Equal(t, simpleMessage().Body, msg.Body)
+	assert.Equal(t, "", msg.HTMLBody)
+}
+
+func TestTemplateError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sources := []string{
+		`no templates defined`,
+		`{{define "text"}}{{.Value}`,
+	}
+
+	for i, source := range sources {
+		filename := filepath.Join(dir, fmt.Sprintf("%d.tmpl", i))
+		require.Nil(t, ioutil.WriteFile(filename, []byte(source), 0600))
+
+		form := *simpleForm
+		form.Template = filename
+		_, err := newSink(&mockDepositor{}, Config{Redirect: location}, &form)
+		assert.NotNil(t, err, source)
+	}
+
+	form := *simpleForm
+	form.Template = filepath.Join(dir, "missing")
+	_, err = newSink(&mockDepositor{}, Config{Redirect: location}, &form)
+	assert.NotNil(t, err)
+}
+
+func TestTemplateExecError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formsink")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "bad.tmpl")
+	err = ioutil.WriteFile(filename, []byte(`{{define "text"}}{{.Nope}}{{end}}`), 0600)
+	require.Nil(t, err)
+
+	mockDepositor := &mockDepositor{}
+	form := *simpleForm
+	form.Template = filename
+	sink, err := newSink(mockDepositor, Config{Redirect: location}, &form)
+	require.Nil(t, err)
+
+	result := post(t, sink)
+	assert.Equal(t, http.StatusInternalServerError, result.StatusCode)
+	assert.Nil(t, mockDepositor.msg)
+}
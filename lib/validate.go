@@ -0,0 +1,177 @@
+package lib
+
+import (
+	"mime/multipart"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// The format of an HTML5 "date" input value, e.g. 2017-02-25.
+const dateLayout = "2006-01-02"
+
+// numberPattern matches an HTML5 "valid floating-point number", e.g. -1.5e3,
+// unlike strconv.ParseFloat, which also takes NaN, Inf, hex and "_".
+var numberPattern = regexp.MustCompile(`^-?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+)(?:[eE][-+]?[0-9]+)?$`)
+
+// FieldError describes a submitted field whose value violates the
+// constraints declared in the HTML.
+type FieldError struct {
+	Field  string
+	Reason string
+}
+
+func (fe *FieldError) Error() string {
+	return fe.Field + ": " + fe.Reason
+}
+
+// validate checks the submitted values and files against the form's
+// constraints and returns one error for each failing field, in the order
+// the fields appear in the form.
+func (f *Form) validate(multipartForm *multipart.Form) []*FieldError {
+	errs := make([]*FieldError, 0)
+
+	for _, name := range f.Fields {
+		c, ok := f.Constraints[name]
+		if !ok {
+			continue
+		}
+		if reason := c.check(multipartForm.Value[name]); reason != "" {
+			errs = append(errs, &FieldError{name, reason})
+		}
+	}
+
+	for _, name := range f.Files {
+		c, ok := f.Constraints[name]
+		if !ok || !c.Required {
+			continue
+		}
+		if !hasFile(multipartForm.File[name]) {
+			errs = append(errs, &FieldError{name, "is required"})
+		}
+	}
+
+	return errs
+}
+
+// check returns why the values violate the constraint, or "" if they
+// don't. As in the browser, only required is checked for empty values.
+func (c *Constraint) check(values []string) string {
+	empty := true
+	for _, v := range values {
+		if v != "" {
+			empty = false
+			break
+		}
+	}
+	if empty {
+		if c.Required {
+			return "is required"
+		}
+		return ""
+	}
+
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		if reason := c.checkValue(v); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+func (c *Constraint) checkValue(v string) string {
+	length := utf8.RuneCountInString(v)
+	if c.MinLength > 0 && length < c.MinLength {
+		return "must be at least " + strconv.Itoa(c.MinLength) + " characters"
+	}
+	if c.MaxLength > 0 && length > c.MaxLength {
+		return "must be at most " + strconv.Itoa(c.MaxLength) + " characters"
+	}
+
+	if c.Options != nil && !c.allows(v) {
+		return "is not one of the allowed options"
+	}
+
+	if c.Pattern != "" {
+		re, err := c.patternRegexp()
+		if err != nil || !re.MatchString(v) {
+			return "does not match the required pattern"
+		}
+	}
+
+	switch c.Type {
+	case "email":
+		addr, err := mail.ParseAddress(v)
+		if err != nil || addr.Name != "" || addr.Address != v {
+			return "must be an email address"
+		}
+	case "url":
+		u, err := url.Parse(v)
+		if err != nil || u.Scheme == "" || (u.Host == "" && u.Opaque == "") {
+			return "must be an absolute URL"
+		}
+	case "number":
+		n, err := parseNumber(v)
+		if err != nil {
+			return "must be a number"
+		}
+		if min, err := parseNumber(c.Min); err == nil && n < min {
+			return "must be at least " + c.Min
+		}
+		if max, err := parseNumber(c.Max); err == nil && n > max {
+			return "must be at most " + c.Max
+		}
+	case "date":
+		d, err := time.Parse(dateLayout, v)
+		if err != nil {
+			return "must be a date (YYYY-MM-DD)"
+		}
+		if min, err := time.Parse(dateLayout, c.Min); err == nil && d.Before(min) {
+			return "must be on or after " + c.Min
+		}
+		if max, err := time.Parse(dateLayout, c.Max); err == nil && d.After(max) {
+			return "must be on or before " + c.Max
+		}
+	}
+
+	return ""
+}
+
+// parseNumber parses the value of a "number" input, or its min or max, as
+// the browser does.
+func parseNumber(s string) (float64, error) {
+	if !numberPattern.MatchString(s) {
+		return 0, e("invalid number %q", s)
+	}
+	return strconv.ParseFloat(s, 64) // Fails for values too large for a float64
+}
+
+func (c *Constraint) allows(v string) bool {
+	for _, option := range c.Options {
+		if option == v {
+			return true
+		}
+	}
+	return false
+}
+
+// patternRegexp compiles the pattern attribute, which must match the
+// whole value rather than a substring.
+func (c *Constraint) patternRegexp() (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + c.Pattern + ")$")
+}
+
+func hasFile(metas []*multipart.FileHeader) bool {
+	for _, meta := range metas {
+		if meta.Filename != "" {
+			return true
+		}
+	}
+	return false
+}
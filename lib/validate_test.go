@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"mime/multipart"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConstraintCheck(t *testing.T) {
+	cases := []struct {
+		constraint *Constraint
+		values     []string
+		ok         bool
+	}{
+		{&Constraint{Required: true}, nil, false},
+		{&Constraint{Required: true}, []string{""}, false},
+		{&Constraint{Required: true}, []string{"x"}, true},
+		{&Constraint{Type: "email"}, nil, true}, // Optional and empty
+		{&Constraint{Type: "email"}, []string{"crasm@vczf.io"}, true},
+		{&Constraint{Type: "email"}, []string{"crasm"}, false},
+		{&Constraint{Type: "email"}, []string{"Crasm <crasm@vczf.io>"}, false},
+		{&Constraint{Type: "url"}, []string{"https://vczf.io/"}, true},
+		{&Constraint{Type: "url"}, []string{"vczf.io"}, false},
+		{&Constraint{Type: "number", Min: "1", Max: "10"}, []string{"5"}, true},
+		{&Constraint{Type: "number", Min: "1", Max: "10"}, []string{"0"}, false},
+		{&Constraint{Type: "number", Min: "1", Max: "10"}, []string{"11"}, false},
+		{&Constraint{Type: "number"}, []string{"five"}, false},
+		{&Constraint{Type: "number"}, []string{"-1.5e3"}, true},
+		{&Constraint{Type: "number"}, []string{".5"}, true},
+		{&Constraint{Type: "number", Min: "0", Max: "10"}, []string{"NaN"}, false},
+		{&Constraint{Type: "number", Min: "0"}, []string{"Inf"}, false},
+		{&Constraint{Type: "number"}, []string{"-Infinity"}, false},
+		{&Constraint{Type: "number"}, []string{"0x1p3"}, false},
+		{&Constraint{Type: "number"}, []string{"1_000"}, false},
+		{&Constraint{Type: "number"}, []string{"+1"}, false},
+		{&Constraint{Type: "number"}, []string{"1."}, false},
+		{&Constraint{Type: "number"}, []string{"1e999"}, false},
+		{&Constraint{Type: "date", Min: "2017-01-01"}, []string{"2017-02-25"}, true},
+		{&Constraint{Type: "date", Min: "2017-01-01"}, []string{"2016-12-31"}, false},
+		{&Constraint{Type: "date", Max: "2017-01-01"}, []string{"2017-01-02"}, false},
+		{&Constraint{Type: "date"}, []string{"02/25/2017"}, false},
+		{&Constraint{MinLength: 2}, []string{"a"}, false},
+		{&Constraint{MaxLength: 2}, []string{"♥♥"}, true},
+		{&Constraint{MaxLength: 2}, []string{"abc"}, false},
+		{&Constraint{Pattern: "[a-z]+"}, []string{"abc"}, true},
+		{&Constraint{Pattern: "[a-z]+"}, []string{"abc1"}, false},
+		{&Constraint{Pattern: "a|b"}, []string{"ab"}, false},
+		{&Constraint{Options: []string{"sales", "support"}}, []string{"sales"}, true},
+		{&Constraint{Options: []string{"sales", "support"}}, []string{"sales", "support"}, true},
+		{&Constraint{Options: []string{"sales", "support"}}, []string{"<script>"}, false},
+		{&Constraint{Options: []string{"sales", "support"}}, []string{"sales", "x"}, false},
+	}
+
+	for _, c := range cases {
+		reason := c.constraint.check(c.values)
+		assert.Equal(t, c.ok, reason == "", "%+v %q: %s", *c.constraint, c.values, reason)
+	}
+}
+
+func TestValidateRequiredFile(t *testing.T) {
+	form := &Form{
+		Name:  "upload",
+		Files: []string{"cv"},
+		Constraints: map[string]*Constraint{
+			"cv": &Constraint{Required: true},
+		},
+	}
+
+	errs := form.validate(&multipart.Form{})
+	assert.Equal(t, []*FieldError{&FieldError{"cv", "is required"}}, errs)
+
+	errs = form.validate(&multipart.Form{
+		File: map[string][]*multipart.FileHeader{
+			"cv": []*multipart.FileHeader{&multipart.FileHeader{Filename: "cv.pdf"}},
+		},
+	})
+	assert.Empty(t, errs)
+}
@@ -0,0 +1,286 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/jpoehls/gophermail"
+)
+
+const defaultWebhookTimeout = 30 * time.Second
+
+// signatureHeader holds the hex-encoded HMAC-SHA256 of a webhook's body,
+// prefixed with "sha256=", so that the receiver can verify that it came
+// from formsink.
+const signatureHeader = "X-Formsink-Signature"
+
+// WebhookConfig describes a URL that submissions are POSTed to as JSON
+// instead of being stored as messages.
+type WebhookConfig struct {
+	URL string
+
+	// Secret is the key the body is signed with, see Sign.
+	Secret string
+
+	// Files is "base64" (the default) to include uploaded files in the
+	// JSON document, or "multipart" to send the document as the "payload"
+	// part of a multipart/form-data body, followed by a part per file.
+	Files string
+
+	// Timeout limits the whole request, including connecting. Defaults to
+	// 30 seconds.
+	Timeout time.Duration
+}
+
+// Sign returns the value of the X-Formsink-Signature header for a webhook
+// body, for receivers to compare with hmac.Equal.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookPayload is the JSON document sent to a webhook.
+type webhookPayload struct {
+	Form     string          `json:"form"`
+	Fields   []webhookField  `json:"fields"` // In document order
+	Files    []webhookFile   `json:"files"`
+	Metadata webhookMetadata `json:"metadata"`
+}
+
+type webhookField struct {
+	Name   string   `json:"name"`
+	Label  string   `json:"label"`
+	Legend string   `json:"legend,omitempty"`
+	Values []string `json:"values"`
+}
+
+type webhookFile struct {
+	Name        string `json:"name"` // Of the field it was uploaded with
+	Label       string `json:"label"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+
+	// Either the contents, in base64, or the name of the multipart part
+	// holding them.
+	Data []byte `json:"data,omitempty"`
+	Part string `json:"part,omitempty"`
+}
+
+type webhookMetadata struct {
+	ID         string    `json:"id,omitempty"`
+	Subject    string    `json:"subject"`
+	From       string    `json:"from"`
+	To         []string  `json:"to"`
+	ReplyTo    string    `json:"reply_to,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Referer    string    `json:"referer,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// webhookDepositor POSTs submissions to a URL. Any response other than 2xx
+// is a failure, which is temporary for 429 and 5xx.
+type webhookDepositor struct {
+	config WebhookConfig
+	client *http.Client
+}
+
+func newWebhookDepositor(config WebhookConfig) (*webhookDepositor, error) {
+	if config.URL == "" {
+		return nil, e("missing webhook URL")
+	}
+	if config.Secret == "" {
+		return nil, e("missing webhook secret")
+	}
+
+	switch config.Files {
+	case "":
+		config.Files = "base64"
+	case "base64", "multipart":
+	default:
+		return nil, e("unknown webhook file encoding %q", config.Files)
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = defaultWebhookTimeout
+	}
+
+	return &webhookDepositor{config, &http.Client{Timeout: config.Timeout}}, nil
+}
+
+// Deposit sends what can be told from the message alone, without any
+// fields or files, if the submission's data isn't known.
+func (wh *webhookDepositor) Deposit(ctx context.Context, s *Submission) error {
+	payload := newWebhookPayload(s.Message, s.Data)
+
+	body := &bytes.Buffer{}
+	contentType := "application/json"
+	if wh.config.Files == "multipart" && len(payload.Files) > 0 {
+		var err error
+		if contentType, err = writeMultipartPayload(body, payload, s.Data); err != nil {
+			return err
+		}
+	} else {
+		for i := range payload.Files {
+			contents, err := readFile(s.Data.Files[i])
+			if err != nil {
+				return err
+			}
+			payload.Files[i].Data = contents
+		}
+		if err := json.NewEncoder(body).Encode(payload); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.config.URL, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "formsink")
+	req.Header.Set(formHeader, payload.Form)
+	req.Header.Set(signatureHeader, Sign(wh.config.Secret, body.Bytes()))
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16)) // Allows reuse
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &WebhookError{resp.StatusCode}
+	}
+	return nil
+}
+
+// WebhookError is a response from a webhook other than 2xx.
+type WebhookError struct {
+	StatusCode int
+}
+
+func (we *WebhookError) Error() string {
+	return e("webhook responded %d %s", we.StatusCode, http.StatusText(we.StatusCode)).Error()
+}
+
+// Temporary reports whether the webhook may accept the submission if it's
+// sent again later.
+func (we *WebhookError) Temporary() bool {
+	return we.StatusCode == http.StatusTooManyRequests || we.StatusCode >= 500
+}
+
+func newWebhookPayload(msg *gophermail.Message, data *TemplateData) *webhookPayload {
+	payload := &webhookPayload{
+		Form:   msg.Headers.Get(formHeader),
+		Fields: []webhookField{},
+		Files:  []webhookFile{},
+		Metadata: webhookMetadata{
+			Subject: msg.Subject,
+			ID:      msg.Headers.Get(submissionHeader),
+			From:    msg.From.String(),
+			To:      []string{},
+			Time:    time.Now(),
+		},
+	}
+	for _, a := range msg.To {
+		payload.Metadata.To = append(payload.Metadata.To, a.String())
+	}
+	if msg.ReplyTo.Address != "" {
+		payload.Metadata.ReplyTo = msg.ReplyTo.String()
+	}
+
+	if data == nil {
+		return payload
+	}
+
+	payload.Form = data.Form.Name
+	payload.Metadata.RemoteAddr = data.Request.RemoteAddr
+	payload.Metadata.UserAgent = data.Request.UserAgent
+	payload.Metadata.Referer = data.Request.Referer
+	payload.Metadata.Time = data.Request.Time
+
+	for _, f := range data.Fields {
+		payload.Fields = append(payload.Fields, webhookField{
+			Name:   f.Name,
+			Label:  f.Label,
+			Legend: f.Legend,
+			Values: f.Values,
+		})
+	}
+	for _, f := range data.Files {
+		payload.Files = append(payload.Files, webhookFile{
+			Name:        f.Name,
+			Label:       f.Label,
+			Filename:    f.Filename,
+			ContentType: f.ContentType,
+			Size:        f.Size,
+		})
+	}
+	return payload
+}
+
+// writeMultipartPayload writes payload as the first part of a
+// multipart/form-data body and each file as a part after it, returning the
+// body's Content-Type.
+func writeMultipartPayload(body *bytes.Buffer, payload *webhookPayload, data *TemplateData) (string, error) {
+	mw := multipart.NewWriter(body)
+
+	for i := range payload.Files {
+		payload.Files[i].Part = fmt.Sprintf("file%d", i)
+	}
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"application/json"},
+		"Content-Disposition": {`form-data; name="payload"`},
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := json.NewEncoder(part).Encode(payload); err != nil {
+		return "", err
+	}
+
+	for i, f := range payload.Files {
+		contentType := f.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {contentType},
+			"Content-Disposition": {fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+				f.Part, escapeQuotes(f.Filename))},
+		})
+		if err != nil {
+			return "", err
+		}
+		contents, err := readFile(data.Files[i])
+		if err != nil {
+			return "", err
+		}
+		part.Write(contents)
+	}
+
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	return mw.FormDataContentType(), nil
+}
+
+// escapeQuotes escapes a quoted-string value, as in mime/multipart.
+func escapeQuotes(s string) string {
+	return strings.NewReplacer("\\", "\\\\", `"`, "\\\"").Replace(s)
+}
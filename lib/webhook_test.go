@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const webhookSecret = "correct horse battery staple"
+
+// Starts a webhook receiver that verifies signatures and records what it
+// receives, responding with status.
+func newWebhookServer(t *testing.T, status int, received chan<- *http.Request, bodies chan<- []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		assert.True(t, hmac.Equal(
+			[]byte(Sign(webhookSecret, body)),
+			[]byte(r.Header.Get(signatureHeader))), "signature")
+
+		received <- r
+		bodies <- body
+		w.WriteHeader(status)
+	}))
+}
+
+func checkPayload(t *testing.T, payload *webhookPayload) {
+	assert.Equal(t, "contact", payload.Form)
+	assert.Equal(t, []webhookField{
+		webhookField{Name: "name", Label: "name", Values: []string{"crasm"}},
+		webhookField{Name: "email", Label: "email", Values: []string{"crasm@formsink.email.vczf.io"}},
+		webhookField{Name: "message", Label: "message", Values: []string{"I &#9829; formsink!"}},
+	}, payload.Fields)
+	require.Len(t, payload.Files, 1)
+	assert.Equal(t, "picture", payload.Files[0].Name)
+	assert.Equal(t, "tiny.ppm", payload.Files[0].Filename)
+	assert.Equal(t, "image/x-portable-pixmap", payload.Files[0].ContentType)
+	assert.Equal(t, int64(53), payload.Files[0].Size)
+	assert.Equal(t, "contact request", payload.Metadata.Subject)
+	assert.Equal(t, "<crasm@formsink.email.vczf.io>", payload.Metadata.ReplyTo)
+	assert.False(t, payload.Metadata.Time.IsZero())
+}
+
+func TestWebhook(t *testing.T) {
+	tiny, err := ioutil.ReadFile("../resources/tiny.ppm")
+	require.Nil(t, err)
+
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := newWebhookServer(t, http.StatusOK, received, bodies)
+	defer server.Close()
+
+	webhook, err := newWebhookDepositor(WebhookConfig{URL: server.URL, Secret: webhookSecret})
+	require.Nil(t, err)
+	sink, err := newSink(webhook, Config{Redirect: location}, simpleForm)
+	require.Nil(t, err)
+
+	result := post(t, sink)
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+
+	r := <-received
+	assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	assert.Equal(t, "contact", r.Header.Get(formHeader))
+
+	payload := &webhookPayload{}
+	require.Nil(t, json.Unmarshal(<-bodies, payload))
+	checkPayload(t, payload)
+	assert.Equal(t, tiny, payload.Files[0].Data)
+	assert.Equal(t, "", payload.Files[0].Part)
+}
+
+func TestWebhookMultipart(t *testing.T) {
+	tiny, err := ioutil.ReadFile("../resources/tiny.ppm")
+	require.Nil(t, err)
+
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := newWebhookServer(t, http.StatusAccepted, received, bodies)
+	defer server.Close()
+
+	webhook, err := newWebhookDepositor(WebhookConfig{
+		URL:    server.URL,
+		Secret: webhookSecret,
+		Files:  "multipart",
+	})
+	require.Nil(t, err)
+	sink, err := newSink(webhook, Config{Redirect: location}, simpleForm)
+	require.Nil(t, err)
+
+	result := post(t, sink)
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+
+	r := <-received
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	require.Nil(t, err)
+	assert.Equal(t, "multipart/form-data", mediaType)
+
+	mr := multipart.NewReader(bytes.NewReader(<-bodies), params["boundary"])
+	part, err := mr.NextPart()
+	require.Nil(t, err)
+	assert.Equal(t, "payload", part.FormName())
+	payload := &webhookPayload{}
+	require.Nil(t, json.NewDecoder(part).Decode(payload))
+	checkPayload(t, payload)
+	assert.Nil(t, payload.Files[0].Data)
+	assert.Equal(t, "file0", payload.Files[0].Part)
+
+	part, err = mr.NextPart()
+	require.Nil(t, err)
+	assert.Equal(t, "file0", part.FormName())
+	assert.Equal(t, "tiny.ppm", part.FileName())
+	data, err := ioutil.ReadAll(part)
+	require.Nil(t, err)
+	assert.Equal(t, tiny, data)
+}
+
+// Only temporary failures, e.g. 503 from the webhook, are 503 in turn.
+func TestWebhookErrors(t *testing.T) {
+	cases := []struct {
+		status int
+		result int
+	}{
+		{http.StatusBadRequest, http.StatusInternalServerError},
+		{http.StatusFound, http.StatusInternalServerError},
+		{http.StatusTooManyRequests, http.StatusServiceUnavailable},
+		{http.StatusBadGateway, http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		received := make(chan *http.Request, 1)
+		bodies := make(chan []byte, 1)
+		server := newWebhookServer(t, c.status, received, bodies)
+		defer server.Close()
+
+		webhook, err := newWebhookDepositor(WebhookConfig{URL: server.URL, Secret: webhookSecret})
+		require.Nil(t, err)
+		sink, err := newSink(webhook, Config{Redirect: location}, simpleForm)
+		require.Nil(t, err)
+
+		result := post(t, sink)
+		assert.Equal(t, c.result, result.StatusCode, http.StatusText(c.status))
+	}
+
+	for _, config := range []WebhookConfig{
+		WebhookConfig{Secret: webhookSecret},
+		WebhookConfig{URL: "http://localhost"},
+		WebhookConfig{URL: "http://localhost", Secret: webhookSecret, Files: "inline"},
+	} {
+		_, err := newWebhookDepositor(config)
+		assert.NotNil(t, err)
+	}
+}
+
+// Without the submission, only what's in the message is sent.
+func TestWebhookMessage(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := newWebhookServer(t, http.StatusNoContent, received, bodies)
+	defer server.Close()
+
+	webhook, err := newWebhookDepositor(WebhookConfig{URL: server.URL, Secret: webhookSecret})
+	require.Nil(t, err)
+	msg := formMessage("contact")
+	require.Nil(t, depositMessage(webhook, msg))
+	<-received
+
+	payload := &webhookPayload{}
+	require.Nil(t, json.Unmarshal(<-bodies, payload))
+	assert.Equal(t, "contact", payload.Form)
+	assert.Empty(t, payload.Fields)
+	assert.Empty(t, payload.Files)
+	assert.Equal(t, []string{"<" + msg.To[0].Address + ">"}, payload.Metadata.To)
+}